@@ -0,0 +1,288 @@
+// Copyright 2020, Chef.  All rights reserved.
+// https://github.com/q191201771/lal
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package remux
+
+import (
+	"bytes"
+
+	"github.com/q191201771/lal/pkg/aac"
+	"github.com/q191201771/lal/pkg/base"
+	"github.com/q191201771/naza/pkg/bele"
+)
+
+// fmp4InitSegmentInfo 构造init segment（ftyp+moov）所需的信息
+//
+type fmp4InitSegmentInfo struct {
+	videoCodecId uint8
+	vcc          []byte // avcC/hvcC payload
+
+	audioCodecId uint8
+	ascCtx       *aac.AscContext
+}
+
+// fmp4Box
+//
+// 通用的box辅助函数，写一个带4字节长度前缀+4字节box type的box
+//
+func fmp4Box(boxType string, payload []byte) []byte {
+	b := make([]byte, 0, 8+len(payload))
+	var lenBuf [4]byte
+	bele.BePutUint32(lenBuf[:], uint32(8+len(payload)))
+	b = append(b, lenBuf[:]...)
+	b = append(b, boxType...)
+	b = append(b, payload...)
+	return b
+}
+
+func packFmp4InitSegment(info fmp4InitSegmentInfo) []byte {
+	ftyp := fmp4Box("ftyp", []byte{
+		'i', 's', 'o', '5', // major_brand
+		0, 0, 0, 1, // minor_version
+		'i', 's', 'o', '5', 'i', 's', 'o', '6', 'm', 'p', '4', '1', // compatible_brands
+	})
+
+	moov := packFmp4Moov(info)
+
+	out := make([]byte, 0, len(ftyp)+len(moov))
+	out = append(out, ftyp...)
+	out = append(out, moov...)
+	return out
+}
+
+func packFmp4Moov(info fmp4InitSegmentInfo) []byte {
+	mvhd := fmp4Box("mvhd", make([]byte, 100)) // 简化填充，真实实现需要填充timescale/duration等字段
+
+	var traks []byte
+	if info.vcc != nil {
+		traks = append(traks, packFmp4VideoTrak(info)...)
+	}
+	if info.ascCtx != nil || info.audioCodecId != 0 {
+		traks = append(traks, packFmp4AudioTrak(info)...)
+	}
+
+	mvex := packFmp4Mvex()
+
+	payload := make([]byte, 0, len(mvhd)+len(traks)+len(mvex))
+	payload = append(payload, mvhd...)
+	payload = append(payload, traks...)
+	payload = append(payload, mvex...)
+	return fmp4Box("moov", payload)
+}
+
+// packFmp4VideoTrak
+//
+// 根据videoCodecId选择avc1/avcC或hvc1/hvcC作为sample description
+//
+func packFmp4VideoTrak(info fmp4InitSegmentInfo) []byte {
+	var sampleEntryType string
+	var configBoxType string
+	switch info.videoCodecId {
+	case base.RtmpCodecIdHevc:
+		sampleEntryType = "hvc1"
+		configBoxType = "hvcC"
+	default:
+		sampleEntryType = "avc1"
+		configBoxType = "avcC"
+	}
+
+	configBox := fmp4Box(configBoxType, info.vcc)
+	sampleEntry := fmp4Box(sampleEntryType, configBox) // 简化：真实sample entry前面还有固定的86字节头部字段
+
+	stsd := fmp4Box("stsd", sampleEntry)
+	stbl := fmp4Box("stbl", stsd)
+	minf := fmp4Box("minf", stbl)
+	mdia := fmp4Box("mdia", minf)
+	tkhd := fmp4Box("tkhd", make([]byte, 84))
+
+	trak := make([]byte, 0, len(tkhd)+len(mdia))
+	trak = append(trak, tkhd...)
+	trak = append(trak, mdia...)
+	return fmp4Box("trak", trak)
+}
+
+// packFmp4AudioTrak
+//
+// AAC使用mp4a/esds（由ASC得来），G.711使用ulaw/alaw，LPCM使用lpcm，MP3使用mp4a（.6B）
+//
+func packFmp4AudioTrak(info fmp4InitSegmentInfo) []byte {
+	var sampleEntryType string
+	switch info.audioCodecId {
+	case base.RtmpSoundFormatG711A:
+		sampleEntryType = "alaw"
+	case base.RtmpSoundFormatG711U:
+		sampleEntryType = "ulaw"
+	case base.RtmpSoundFormatLinearPcm, base.RtmpSoundFormatLinearPcmLe:
+		sampleEntryType = "lpcm"
+	default:
+		sampleEntryType = "mp4a"
+	}
+
+	var configBox []byte
+	if info.ascCtx != nil {
+		configBox = fmp4Box("esds", info.ascCtx.ConfigBytes())
+	}
+	sampleEntry := fmp4Box(sampleEntryType, configBox)
+
+	stsd := fmp4Box("stsd", sampleEntry)
+	stbl := fmp4Box("stbl", stsd)
+	minf := fmp4Box("minf", stbl)
+	mdia := fmp4Box("mdia", minf)
+	tkhd := fmp4Box("tkhd", make([]byte, 84))
+
+	trak := make([]byte, 0, len(tkhd)+len(mdia))
+	trak = append(trak, tkhd...)
+	trak = append(trak, mdia...)
+	return fmp4Box("trak", trak)
+}
+
+func packFmp4Mvex() []byte {
+	trexVideo := fmp4Box("trex", packFmp4Trex(fmp4TrackIdVideo))
+	trexAudio := fmp4Box("trex", packFmp4Trex(fmp4TrackIdAudio))
+	payload := make([]byte, 0, len(trexVideo)+len(trexAudio))
+	payload = append(payload, trexVideo...)
+	payload = append(payload, trexAudio...)
+	return fmp4Box("mvex", payload)
+}
+
+// packFmp4Trex
+//
+// default_sample_duration在这里只是一个兜底值（trun始终带sample-duration-present标记，实际以trun里的值为准），
+// 填0会被部分demuxer当作异常值处理，因此按90kHz时间基给一个近似帧间隔的默认值
+//
+func packFmp4Trex(trackId uint32) []byte {
+	b := make([]byte, 24)
+	bele.BePutUint32(b[4:], trackId)
+	bele.BePutUint32(b[8:], 1) // default_sample_description_index
+	bele.BePutUint32(b[12:], fmp4Timescale/25)
+	return b
+}
+
+// packFmp4MediaSegment
+//
+// styp+moof+mdat，每个fmp4 frame对应一个独立的fragment，boundary为true时表示新CMAF segment的起点
+//
+// @param duration: 该sample的播放时长（90kHz），由调用方根据同轨道上一帧的dts算出，写入trun.sample_duration
+//
+func packFmp4MediaSegment(frame *Fmp4Frame, seq uint32, duration uint32, boundary bool) []byte {
+	styp := fmp4Box("styp", []byte{
+		'm', 's', 'd', 'h',
+		0, 0, 0, 0,
+		'm', 's', 'd', 'h', 'm', 's', 'i', 'x',
+	})
+
+	moof := packFmp4Moof(frame, seq, duration)
+
+	// trun.data_offset是从moof box起始处到本sample在mdat中的数据起始处的偏移，
+	// 固定为 len(moof) + mdat box头(8字节)
+	patchFmp4TrunDataOffset(moof, uint32(len(moof)+8))
+
+	mdat := fmp4Box("mdat", frame.Raw)
+
+	out := make([]byte, 0, len(styp)+len(moof)+len(mdat))
+	if boundary {
+		out = append(out, styp...)
+	}
+	out = append(out, moof...)
+	out = append(out, mdat...)
+	return out
+}
+
+// patchFmp4TrunDataOffset 在已经拼好的moof字节流中就地回填trun.data_offset字段
+//
+// trun box内data_offset字段紧跟在box header(8字节)+flags(4字节)+sample_count(4字节)之后
+//
+func patchFmp4TrunDataOffset(moof []byte, dataOffset uint32) {
+	idx := bytes.Index(moof, []byte("trun"))
+	if idx < 0 {
+		return
+	}
+	pos := idx + 4 + 4 + 4 // "trun" + flags + sample_count
+	if pos+4 > len(moof) {
+		return
+	}
+	bele.BePutUint32(moof[pos:pos+4], dataOffset)
+}
+
+func packFmp4Moof(frame *Fmp4Frame, seq uint32, duration uint32) []byte {
+	mfhd := fmp4Box("mfhd", packFmp4Mfhd(seq))
+	traf := fmp4Box("traf", packFmp4Traf(frame, duration))
+
+	payload := make([]byte, 0, len(mfhd)+len(traf))
+	payload = append(payload, mfhd...)
+	payload = append(payload, traf...)
+	return fmp4Box("moof", payload)
+}
+
+func packFmp4Mfhd(seq uint32) []byte {
+	b := make([]byte, 8)
+	bele.BePutUint32(b[4:], seq)
+	return b
+}
+
+func packFmp4Traf(frame *Fmp4Frame, duration uint32) []byte {
+	tfhd := fmp4Box("tfhd", packFmp4Tfhd(frame.TrackId))
+	tfdt := fmp4Box("tfdt", packFmp4Tfdt(frame.Dts))
+	trun := fmp4Box("trun", packFmp4Trun(frame, duration))
+
+	payload := make([]byte, 0, len(tfhd)+len(tfdt)+len(trun))
+	payload = append(payload, tfhd...)
+	payload = append(payload, tfdt...)
+	payload = append(payload, trun...)
+	return fmp4Box("traf", payload)
+}
+
+func packFmp4Tfhd(trackId uint32) []byte {
+	b := make([]byte, 8)
+	bele.BePutUint32(b[4:], trackId)
+	return b
+}
+
+// packFmp4Tfdt
+//
+// tfdt.baseMediaDecodeTime = TimestampAbs*timescale，90kHz时间基下即dts本身（dts已经是*90过的）
+//
+func packFmp4Tfdt(dts uint64) []byte {
+	b := make([]byte, 12)
+	b[0] = 1 // version 1，使用64位baseMediaDecodeTime
+	bele.BePutUint64(b[4:], dts)
+	return b
+}
+
+// packFmp4Trun
+//
+// 每个fragment只包含一个sample，composition time offset使用cts*90（cts已经是90kHz单位）
+// data_offset先填0，由packFmp4MediaSegment在moof拼好之后通过patchFmp4TrunDataOffset回填真实值
+//
+func packFmp4Trun(frame *Fmp4Frame, duration uint32) []byte {
+	b := make([]byte, 0, 20)
+	flags := [4]byte{0x00, 0x00, 0x0F, 0x01} // data-offset-present | sample-duration/size/flags/composition-time-offset present，sample_count=1
+	b = append(b, flags[:]...)
+	var sampleCountBuf [4]byte
+	bele.BePutUint32(sampleCountBuf[:], 1)
+	b = append(b, sampleCountBuf[:]...)
+	var dataOffsetBuf [4]byte
+	bele.BePutUint32(dataOffsetBuf[:], 0) // 回填见patchFmp4TrunDataOffset
+	b = append(b, dataOffsetBuf[:]...)
+
+	var durBuf, sizeBuf, flagsBuf, ctsBuf [4]byte
+	bele.BePutUint32(durBuf[:], duration)
+	bele.BePutUint32(sizeBuf[:], uint32(len(frame.Raw)))
+	if frame.Key {
+		bele.BePutUint32(flagsBuf[:], 0x02000000) // sample_depends_on=2（不依赖其他sample）
+	} else {
+		bele.BePutUint32(flagsBuf[:], 0x01010000) // sample_depends_on=1 & non-sync sample
+	}
+	bele.BePutUint32(ctsBuf[:], frame.Cts)
+
+	b = append(b, durBuf[:]...)
+	b = append(b, sizeBuf[:]...)
+	b = append(b, flagsBuf[:]...)
+	b = append(b, ctsBuf[:]...)
+	return b
+}
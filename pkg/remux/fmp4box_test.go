@@ -0,0 +1,67 @@
+// Copyright 2020, Chef.  All rights reserved.
+// https://github.com/q191201771/lal
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package remux
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/q191201771/naza/pkg/bele"
+)
+
+func TestPackFmp4MediaSegment_DataOffset(t *testing.T) {
+	frame := &Fmp4Frame{
+		TrackId: fmp4TrackIdVideo,
+		Dts:     90000,
+		Cts:     0,
+		Key:     true,
+		Raw:     []byte{0, 0, 0, 4, 0x65, 0x88, 0x84, 0x00},
+	}
+
+	b := packFmp4MediaSegment(frame, 1, 3000, true)
+
+	idx := bytes.Index(b, []byte("trun"))
+	if idx < 0 {
+		t.Fatal("trun box not found")
+	}
+	dataOffsetPos := idx + 4 + 4 + 4
+	gotDataOffset := bele.BeUint32(b[dataOffsetPos : dataOffsetPos+4])
+
+	moofIdx := bytes.Index(b, []byte("moof"))
+	mdatIdx := bytes.Index(b, []byte("mdat"))
+	if moofIdx < 0 || mdatIdx < 0 {
+		t.Fatal("moof/mdat box not found")
+	}
+	moofLen := mdatIdx - moofIdx // "moof"/"mdat"都位于各自box起始处之后4字节，两者之差即moof box的总长度
+	wantDataOffset := uint32(moofLen + 8)
+
+	if gotDataOffset != wantDataOffset {
+		t.Errorf("data_offset mismatch. got=%d, want=%d", gotDataOffset, wantDataOffset)
+	}
+
+	durationPos := idx + 4 + 4 + 4 + 4 // "trun"+flags(4)+sample_count(4)+data_offset(4) -> duration字段起始
+	gotDuration := bele.BeUint32(b[durationPos : durationPos+4])
+	if gotDuration != 3000 {
+		t.Errorf("sample_duration mismatch. got=%d, want=3000", gotDuration)
+	}
+}
+
+func TestPatchFmp4TrunDataOffset(t *testing.T) {
+	frame := &Fmp4Frame{TrackId: fmp4TrackIdAudio, Dts: 0, Raw: []byte{1, 2, 3}}
+	moof := packFmp4Moof(frame, 1, 0)
+
+	patchFmp4TrunDataOffset(moof, 0x12345678)
+
+	idx := bytes.Index(moof, []byte("trun"))
+	pos := idx + 4 + 4 + 4
+	got := bele.BeUint32(moof[pos : pos+4])
+	if got != 0x12345678 {
+		t.Errorf("patched data_offset mismatch. got=%#x, want=%#x", got, 0x12345678)
+	}
+}
@@ -0,0 +1,60 @@
+// Copyright 2020, Chef.  All rights reserved.
+// https://github.com/q191201771/lal
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package remux
+
+// id3 timed metadata的打包辅助函数
+//
+// ID3v2.3标签结构：
+//   10字节header："ID3" + 2字节version + 1字节flags + 4字节synchsafe size
+//   若干frame：4字节frame id + 4字节synchsafe size + 2字节flags + frame payload
+//
+// TXXX（用户自定义文本信息）frame payload：1字节text encoding + description(以\0结尾) + value
+
+// packId3TxxxTag 将一段文本打包成一个完整的ID3v2.3标签，只包含一个TXXX frame
+//
+func packId3TxxxTag(description string, value string) []byte {
+	frame := packId3TxxxFrame(description, value)
+	return packId3Tag(frame)
+}
+
+func packId3Tag(frames []byte) []byte {
+	b := make([]byte, 0, 10+len(frames))
+	b = append(b, 'I', 'D', '3')
+	b = append(b, 3, 0) // version 2.3.0
+	b = append(b, 0)    // flags
+	b = append(b, synchsafe(uint32(len(frames)))...)
+	b = append(b, frames...)
+	return b
+}
+
+func packId3TxxxFrame(description string, value string) []byte {
+	payload := make([]byte, 0, 1+len(description)+1+len(value))
+	payload = append(payload, 0x03) // text encoding: UTF-8
+	payload = append(payload, description...)
+	payload = append(payload, 0x00)
+	payload = append(payload, value...)
+
+	b := make([]byte, 0, 10+len(payload))
+	b = append(b, 'T', 'X', 'X', 'X')
+	b = append(b, synchsafe(uint32(len(payload)))...)
+	b = append(b, 0, 0) // flags
+	b = append(b, payload...)
+	return b
+}
+
+// synchsafe 按ID3规范把一个32bit长度编码成4字节、每字节最高位为0的synchsafe integer
+//
+func synchsafe(v uint32) []byte {
+	return []byte{
+		byte((v >> 21) & 0x7F),
+		byte((v >> 14) & 0x7F),
+		byte((v >> 7) & 0x7F),
+		byte(v & 0x7F),
+	}
+}
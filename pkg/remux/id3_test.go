@@ -0,0 +1,58 @@
+// Copyright 2020, Chef.  All rights reserved.
+// https://github.com/q191201771/lal
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package remux
+
+import (
+	"testing"
+)
+
+func TestPackId3TxxxTag(t *testing.T) {
+	tag := packId3TxxxTag("onMetaData", "hello")
+
+	if string(tag[0:3]) != "ID3" {
+		t.Fatalf("id3 magic mismatch. got=%s", tag[0:3])
+	}
+	if tag[3] != 3 || tag[4] != 0 {
+		t.Fatalf("id3 version mismatch. got=%d.%d", tag[3], tag[4])
+	}
+	if tag[5] != 0 {
+		t.Fatalf("id3 flags should be 0. got=%#x", tag[5])
+	}
+
+	size := unsynchsafe(tag[6:10])
+	frames := tag[10:]
+	if int(size) != len(frames) {
+		t.Fatalf("tag size mismatch. got=%d, want=%d", size, len(frames))
+	}
+
+	if string(frames[0:4]) != "TXXX" {
+		t.Fatalf("frame id mismatch. got=%s", frames[0:4])
+	}
+	frameSize := unsynchsafe(frames[4:8])
+	payload := frames[10 : 10+frameSize]
+	if payload[0] != 0x03 {
+		t.Fatalf("text encoding mismatch. got=%#x", payload[0])
+	}
+
+	gotDescription := string(payload[1:11])
+	if gotDescription != "onMetaData" {
+		t.Fatalf("description mismatch. got=%s", gotDescription)
+	}
+	if payload[11] != 0x00 {
+		t.Fatalf("description terminator mismatch. got=%#x", payload[11])
+	}
+	gotValue := string(payload[12:])
+	if gotValue != "hello" {
+		t.Fatalf("value mismatch. got=%s", gotValue)
+	}
+}
+
+func unsynchsafe(b []byte) uint32 {
+	return uint32(b[0])<<21 | uint32(b[1])<<14 | uint32(b[2])<<7 | uint32(b[3])
+}
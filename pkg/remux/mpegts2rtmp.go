@@ -0,0 +1,424 @@
+// Copyright 2020, Chef.  All rights reserved.
+// https://github.com/q191201771/lal
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package remux
+
+import (
+	"github.com/q191201771/lal/pkg/aac"
+	"github.com/q191201771/lal/pkg/avc"
+	"github.com/q191201771/lal/pkg/base"
+	"github.com/q191201771/lal/pkg/hevc"
+	"github.com/q191201771/lal/pkg/mpegts"
+	"github.com/q191201771/naza/pkg/bele"
+)
+
+const tsPacketSize = 188
+
+type Mpegts2RtmpRemuxerObserver interface {
+	// OnRtmpMsg
+	//
+	// @param msg: msg.Payload 回调结束后，函数内部不会再使用这块内存，上层可以随意持有或修改
+	//
+	// @param boundary: 是否是视频关键帧的起始点，方便下游按GOP切片/转发
+	//
+	OnRtmpMsg(msg base.RtmpMsg, boundary bool)
+}
+
+// tsPesAssembler 按pid缓存一个尚未拼完整的PES包
+//
+type tsPesAssembler struct {
+	pid       uint16
+	streamId  uint8
+	buf       []byte
+	pesLen    int  // PES_packet_length，0表示长度未知（视频常见），靠下次pusi截断
+	pts, dts  uint64
+	gotPts    bool
+	cc        uint8
+}
+
+// Mpegts2RtmpRemuxer 输入mpegts流（188字节TS包），输出rtmp消息，用于lalserver反向拉取TS源后转推RTMP
+//
+type Mpegts2RtmpRemuxer struct {
+	UniqueKey string
+
+	observer Mpegts2RtmpRemuxerObserver
+
+	remainder []byte // 不足188字节的残留数据，等待下次FeedTsPackets补齐
+
+	videoPid     uint16
+	audioPid     uint16
+	videoCodecId uint8 // base.RtmpCodecIdAvc/base.RtmpCodecIdHevc，从PMT的stream_type得出
+	audioCodecId uint8 // base.RtmpSoundFormatXXX
+
+	videoAssembler *tsPesAssembler
+	audioAssembler *tsPesAssembler
+
+	vpsSpsPpsSent bool // 是否已经往下游发送过一次RTMP video seq header
+	aacAscSent    bool // 是否已经往下游发送过一次RTMP aac seq header
+
+	videoOut []byte // AVCC格式缓冲区 TODO chef: 优化这块buff
+}
+
+func NewMpegts2RtmpRemuxer(observer Mpegts2RtmpRemuxerObserver) *Mpegts2RtmpRemuxer {
+	return &Mpegts2RtmpRemuxer{
+		UniqueKey: base.GenUkRtmp2MpegtsRemuxer(),
+		observer:  observer,
+		videoOut:  make([]byte, 0, 1024*1024),
+		videoPid:  mpegts.PidVideo,
+		audioPid:  mpegts.PidAudio,
+	}
+}
+
+// FeedTsPackets
+//
+// @param b: 一个或多个188字节TS包拼接而成，内部不要求以PAT开头，但必须已经经过PAT/PMT（用于更新videoPid/audioPid/codecId）
+//
+func (s *Mpegts2RtmpRemuxer) FeedTsPackets(b []byte) {
+	s.remainder = append(s.remainder, b...)
+
+	for len(s.remainder) >= tsPacketSize {
+		if s.remainder[0] != 0x47 {
+			// 同步字节不对，丢弃一个字节后重新同步
+			s.remainder = s.remainder[1:]
+			continue
+		}
+		packet := s.remainder[:tsPacketSize]
+		s.remainder = s.remainder[tsPacketSize:]
+		s.feedPacket(packet)
+	}
+}
+
+// ----- private -------------------------------------------------------------------------------------------------------
+
+func (s *Mpegts2RtmpRemuxer) feedPacket(packet []byte) {
+	pusi := packet[1]&0x40 != 0
+	pid := uint16(packet[1]&0x1F)<<8 | uint16(packet[2])
+	hasAdaptation := packet[3]&0x20 != 0
+	hasPayload := packet[3]&0x10 != 0
+
+	payload := packet[4:]
+	if hasAdaptation {
+		if len(payload) == 0 {
+			return
+		}
+		adaptationLen := int(payload[0])
+		if 1+adaptationLen > len(payload) {
+			return
+		}
+		payload = payload[1+adaptationLen:]
+	}
+	if !hasPayload {
+		return
+	}
+
+	switch pid {
+	case mpegts.PidPat:
+		// PAT解析省略，videoPid/audioPid默认采用mpegts包固定分配的PidVideo/PidAudio
+	case mpegts.PidPmt:
+		s.parsePmt(payload, pusi)
+	case s.videoPid:
+		s.feedPes(s.getOrCreateAssembler(&s.videoAssembler, pid), payload, pusi, false)
+	case s.audioPid:
+		s.feedPes(s.getOrCreateAssembler(&s.audioAssembler, pid), payload, pusi, true)
+	}
+}
+
+// parsePmt
+//
+// 从PMT中取出视频、音频的stream_type并映射成RTMP的codec id/sound format，更新videoPid/audioPid
+//
+func (s *Mpegts2RtmpRemuxer) parsePmt(payload []byte, pusi bool) {
+	if !pusi || len(payload) < 1 {
+		return
+	}
+	pointerField := int(payload[0])
+	if 1+pointerField >= len(payload) {
+		return
+	}
+	section := payload[1+pointerField:]
+	if len(section) < 12 {
+		return
+	}
+	sectionLength := int(section[1]&0xF)<<8 | int(section[2])
+	if 3+sectionLength > len(section) {
+		return
+	}
+	programInfoLength := int(section[10]&0xF)<<8 | int(section[11])
+	i := 12 + programInfoLength
+	end := 3 + sectionLength - 4 // 去掉末尾CRC32
+	for i+5 <= end && i+5 <= len(section) {
+		streamType := section[i]
+		pid := uint16(section[i+1]&0x1F)<<8 | uint16(section[i+2])
+		esInfoLength := int(section[i+3]&0xF)<<8 | int(section[i+4])
+
+		switch streamType {
+		case mpegts.StreamTypeH264:
+			s.videoPid = pid
+			s.videoCodecId = base.RtmpCodecIdAvc
+		case mpegts.StreamTypeH265:
+			s.videoPid = pid
+			s.videoCodecId = base.RtmpCodecIdHevc
+		case mpegts.StreamTypeAac:
+			s.audioPid = pid
+			s.audioCodecId = base.RtmpSoundFormatAac
+		case mpegts.StreamTypeMp3:
+			s.audioPid = pid
+			s.audioCodecId = base.RtmpSoundFormatMp3
+		}
+
+		i += 5 + esInfoLength
+	}
+}
+
+func (s *Mpegts2RtmpRemuxer) getOrCreateAssembler(slot **tsPesAssembler, pid uint16) *tsPesAssembler {
+	if *slot == nil {
+		*slot = &tsPesAssembler{pid: pid}
+	}
+	return *slot
+}
+
+// feedPes
+//
+// 按PID重组PES包，PUSI置位表示新PES包的开始，此时上一个缓存的PES包可以交付解析
+//
+func (s *Mpegts2RtmpRemuxer) feedPes(asm *tsPesAssembler, payload []byte, pusi bool, isAudio bool) {
+	if pusi {
+		if len(asm.buf) > 0 {
+			s.dispatchPes(asm, isAudio)
+		}
+		asm.buf = asm.buf[:0]
+		asm.gotPts = false
+	}
+	asm.buf = append(asm.buf, payload...)
+}
+
+// dispatchPes
+//
+// 解析PES头部，拿到pts/dts，并把ES数据转换成RTMP消息后回调给observer
+//
+func (s *Mpegts2RtmpRemuxer) dispatchPes(asm *tsPesAssembler, isAudio bool) {
+	b := asm.buf
+	if len(b) < 9 || b[0] != 0x00 || b[1] != 0x00 || b[2] != 0x01 {
+		return
+	}
+	ptsDtsFlags := b[7] >> 6
+	headerDataLen := int(b[8])
+	if 9+headerDataLen > len(b) {
+		return
+	}
+	// PTS/DTS各占5字节，headerDataLen声明够长不代表asm.buf真的收全了（可能是来源流本身被截断/畸形），
+	// 需要按标志位各自再检查一次实际可读长度，避免越界panic
+	if ptsDtsFlags&0x2 != 0 && len(b) < 14 {
+		return
+	}
+	if ptsDtsFlags&0x1 != 0 && len(b) < 19 {
+		return
+	}
+
+	var pts, dts uint64
+	if ptsDtsFlags&0x2 != 0 {
+		pts = parseTsTimestamp(b[9:14])
+		dts = pts
+	}
+	if ptsDtsFlags&0x1 != 0 {
+		dts = parseTsTimestamp(b[14:19])
+	}
+
+	es := b[9+headerDataLen:]
+
+	if isAudio {
+		s.onAudioEs(es, pts)
+	} else {
+		s.onVideoEs(es, pts, dts)
+	}
+}
+
+// parseTsTimestamp 解析PES头里5字节、33bit的pts/dts
+//
+func parseTsTimestamp(b []byte) uint64 {
+	v := (uint64(b[0]&0xE) << 29) | (uint64(b[1]) << 22) | (uint64(b[2]&0xFE) << 14) | (uint64(b[3]) << 7) | uint64(b[4]>>1)
+	return v
+}
+
+// onVideoEs
+//
+// es为Annex-B格式（带00 00 00 01/00 00 01起始码）的一个或多个NALU，转换成AVCC后，
+// 首次遇到SPS/PPS（/VPS）时合成RTMP video seq header，再发送实际的视频帧消息
+//
+func (s *Mpegts2RtmpRemuxer) onVideoEs(es []byte, pts, dts uint64) {
+	nals, err := avc.SplitNaluAnnexb(es)
+	if err != nil {
+		Log.Errorf("[%s] split annexb nalu failed. err=%+v", s.UniqueKey, err)
+		return
+	}
+
+	var vps, sps, pps []byte
+	var keyframe bool
+	out := s.videoOut[0:0]
+
+	for _, nal := range nals {
+		var nalType uint8
+		switch s.videoCodecId {
+		case base.RtmpCodecIdHevc:
+			nalType = hevc.ParseNaluType(nal[0])
+			switch nalType {
+			case hevc.NaluTypeVps:
+				vps = nal
+				continue
+			case hevc.NaluTypeSps:
+				sps = nal
+				continue
+			case hevc.NaluTypePps:
+				pps = nal
+				continue
+			case hevc.NaluTypeSliceIdr, hevc.NaluTypeSliceIdrNlp, hevc.NaluTypeSliceCranut:
+				keyframe = true
+			}
+		default:
+			nalType = avc.ParseNaluType(nal[0])
+			switch nalType {
+			case avc.NaluTypeSps:
+				sps = nal
+				continue
+			case avc.NaluTypePps:
+				pps = nal
+				continue
+			case avc.NaluTypeIdrSlice:
+				keyframe = true
+			}
+		}
+
+		var lenBuf [4]byte
+		bele.BePutUint32(lenBuf[:], uint32(len(nal)))
+		out = append(out, lenBuf[:]...)
+		out = append(out, nal...)
+	}
+
+	if !s.vpsSpsPpsSent && sps != nil && pps != nil {
+		var seqHeader []byte
+		var err error
+		switch s.videoCodecId {
+		case base.RtmpCodecIdHevc:
+			seqHeader, err = hevc.VpsSpsPpsNalu2AnnexbSeqHeader(vps, sps, pps)
+		default:
+			seqHeader, err = avc.SpsPpsNalu2AvcSeqHeader(sps, pps)
+		}
+		if err != nil {
+			Log.Errorf("[%s] build video seq header failed. err=%+v", s.UniqueKey, err)
+		} else {
+			s.vpsSpsPpsSent = true
+			s.observer.OnRtmpMsg(s.packSeqHeaderMsg(seqHeader, dts), false)
+		}
+	}
+
+	if len(out) == 0 {
+		return
+	}
+
+	cts := uint32(pts-dts) / 90
+	s.observer.OnRtmpMsg(s.packVideoMsg(out, cts, dts, keyframe), keyframe)
+}
+
+// onAudioEs
+//
+// es为ADTS格式的AAC帧（可能包含多帧），转成裸AAC后，首帧到达时顺带根据ADTS头合成seq header
+//
+func (s *Mpegts2RtmpRemuxer) onAudioEs(es []byte, pts uint64) {
+	if s.audioCodecId != base.RtmpSoundFormatAac {
+		// 非AAC（例如MP3）直接原样转发，不需要额外的seq header
+		s.observer.OnRtmpMsg(s.packAudioMsg(es, pts, false), false)
+		return
+	}
+
+	frames, err := aac.SplitAdtsFrame(es)
+	if err != nil {
+		Log.Errorf("[%s] split adts frame failed. err=%+v", s.UniqueKey, err)
+		return
+	}
+
+	for _, f := range frames {
+		if !s.aacAscSent {
+			asc, err := aac.AdtsHeader2Asc(f)
+			if err != nil {
+				Log.Errorf("[%s] build aac asc failed. err=%+v", s.UniqueKey, err)
+			} else {
+				s.aacAscSent = true
+				s.observer.OnRtmpMsg(s.packAudioMsg(asc, pts, true), false)
+			}
+		}
+		s.observer.OnRtmpMsg(s.packAudioMsg(f[7:], pts, false), false) // 7字节ADTS头之后是裸AAC数据
+	}
+}
+
+func (s *Mpegts2RtmpRemuxer) packSeqHeaderMsg(payload []byte, dts uint64) base.RtmpMsg {
+	header := [5]byte{0x10 | s.videoCodecId, 0, 0, 0, 0} // FrameType=1(key) | CodecId, AVCPacketType=0(seq header), cts=0
+
+	b := make([]byte, 0, 5+len(payload))
+	b = append(b, header[:]...)
+	b = append(b, payload...)
+
+	var msg base.RtmpMsg
+	msg.Header.MsgTypeId = base.RtmpTypeIdVideo
+	msg.Header.TimestampAbs = uint32(dts / 90)
+	msg.Header.MsgLen = uint32(len(b))
+	msg.Payload = b
+	return msg
+}
+
+func (s *Mpegts2RtmpRemuxer) packVideoMsg(payload []byte, cts uint32, dts uint64, keyframe bool) base.RtmpMsg {
+	var frameType byte = 0x20 // 2=inter frame
+	if keyframe {
+		frameType = 0x10 // 1=key frame
+	}
+
+	var header [5]byte
+	header[0] = frameType | s.videoCodecId
+	header[1] = 1 // AVCPacketType=1，NALU
+	ctsBuf := make([]byte, 3)
+	bele.BePutUint24(ctsBuf, cts)
+	header[2], header[3], header[4] = ctsBuf[0], ctsBuf[1], ctsBuf[2]
+
+	b := make([]byte, 0, 5+len(payload))
+	b = append(b, header[:]...)
+	b = append(b, payload...)
+
+	var msg base.RtmpMsg
+	msg.Header.MsgTypeId = base.RtmpTypeIdVideo
+	msg.Header.TimestampAbs = uint32(dts / 90)
+	msg.Header.MsgLen = uint32(len(b))
+	msg.Payload = b
+	return msg
+}
+
+func (s *Mpegts2RtmpRemuxer) packAudioMsg(payload []byte, pts uint64, seqHeader bool) base.RtmpMsg {
+	var header byte
+	switch s.audioCodecId {
+	case base.RtmpSoundFormatAac:
+		header = base.RtmpSoundFormatAac<<4 | 0x0F // 固定44kHz/16bit/stereo标记位，具体由ASC描述
+	default:
+		header = s.audioCodecId << 4
+	}
+
+	b := make([]byte, 0, 2+len(payload))
+	b = append(b, header)
+	if s.audioCodecId == base.RtmpSoundFormatAac {
+		if seqHeader {
+			b = append(b, base.RtmpAacPacketTypeSeqHeader)
+		} else {
+			b = append(b, base.RtmpAacPacketTypeRaw)
+		}
+	}
+	b = append(b, payload...)
+
+	var msg base.RtmpMsg
+	msg.Header.MsgTypeId = base.RtmpTypeIdAudio
+	msg.Header.TimestampAbs = uint32(pts / 90)
+	msg.Header.MsgLen = uint32(len(b))
+	msg.Payload = b
+	return msg
+}
@@ -0,0 +1,202 @@
+// Copyright 2020, Chef.  All rights reserved.
+// https://github.com/q191201771/lal
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package remux
+
+import (
+	"testing"
+
+	"github.com/q191201771/lal/pkg/base"
+	"github.com/q191201771/lal/pkg/mpegts"
+	"github.com/q191201771/naza/pkg/bele"
+)
+
+type testMpegts2RtmpObserver struct {
+	msgs       []base.RtmpMsg
+	boundaries []bool
+}
+
+func (o *testMpegts2RtmpObserver) OnRtmpMsg(msg base.RtmpMsg, boundary bool) {
+	o.msgs = append(o.msgs, msg)
+	o.boundaries = append(o.boundaries, boundary)
+}
+
+// TestDispatchPes_TruncatedPesHeaderDoesNotPanic
+//
+// headerDataLen=0但ptsDtsFlags声明PTS/DTS都存在时，PES头实际不足14/19字节，
+// dispatchPes应该直接丢弃这个包，而不是越界panic
+//
+func TestDispatchPes_TruncatedPesHeaderDoesNotPanic(t *testing.T) {
+	s := NewMpegts2RtmpRemuxer(&testMpegts2RtmpObserver{})
+	observer := &testMpegts2RtmpObserver{}
+	s.observer = observer
+
+	buf := []byte{0x00, 0x00, 0x01, 0xE0, 0x00, 0x00, 0x80, 0xC0, 0x00} // 9字节，ptsDtsFlags=0x3, headerDataLen=0
+	asm := &tsPesAssembler{pid: mpegts.PidVideo, buf: buf}
+
+	s.dispatchPes(asm, false)
+
+	if len(observer.msgs) != 0 {
+		t.Fatalf("expected no rtmp msg dispatched for truncated pes header, got %d", len(observer.msgs))
+	}
+}
+
+func packPesTimestamp(prefix byte, pts uint64) []byte {
+	v := pts & 0x1FFFFFFFF
+	b := make([]byte, 5)
+	b[0] = prefix<<4 | byte((v>>30)&0x7)<<1 | 1
+	b[1] = byte(v >> 22)
+	b[2] = byte((v>>15)&0x7F)<<1 | 1
+	b[3] = byte(v >> 7)
+	b[4] = byte(v&0x7F)<<1 | 1
+	return b
+}
+
+func TestParseTsTimestamp_RoundTrip(t *testing.T) {
+	const pts = uint64(0x1FFFFFFFF) - 12345
+
+	got := parseTsTimestamp(packPesTimestamp(0x2, pts))
+	if got != pts&0x1FFFFFFFF {
+		t.Fatalf("pts round trip mismatch. got=%#x, want=%#x", got, pts&0x1FFFFFFFF)
+	}
+}
+
+// buildPmtSectionPayload 拼一个携带若干elementary stream entry的PMT section，外面包一层pointer_field，
+// 形式与Mpegts2RtmpRemuxer.parsePmt期望的payload一致（不含ts包头）
+//
+func buildPmtSectionPayload(entries ...pmtEsEntry) []byte {
+	head := []byte{
+		0x00, 0x01, // program_number
+		0xC1,       // version_number/current_next_indicator
+		0x00,       // section_number
+		0x00,       // last_section_number
+		0xE1, 0x00, // reserved+PCR_PID
+		0xF0, 0x00, // reserved+program_info_length=0
+	}
+	var esEntries []byte
+	for _, e := range entries {
+		esEntries = append(esEntries, packPmtEsEntry(e)...)
+	}
+
+	body := append([]byte{}, head...)
+	body = append(body, esEntries...)
+
+	section := []byte{0x02} // table_id
+	sectionLength := len(body) + 4
+	var secLenBuf [2]byte
+	bele.BePutUint16(secLenBuf[:], uint16(sectionLength)&0xFFF|0x3000)
+	section = append(section, secLenBuf[:]...)
+	section = append(section, body...)
+
+	crc := crc32Mpeg(section)
+	var crcBuf [4]byte
+	bele.BePutUint32(crcBuf[:], crc)
+	section = append(section, crcBuf[:]...)
+
+	payload := make([]byte, 0, 1+len(section))
+	payload = append(payload, 0x00) // pointer_field
+	payload = append(payload, section...)
+	return payload
+}
+
+func TestParsePmt_UpdatesVideoAudioPidAndCodec(t *testing.T) {
+	s := NewMpegts2RtmpRemuxer(&testMpegts2RtmpObserver{})
+
+	payload := buildPmtSectionPayload(
+		pmtEsEntry{streamType: mpegts.StreamTypeH264, pid: 0x101},
+		pmtEsEntry{streamType: mpegts.StreamTypeMp3, pid: 0x102},
+	)
+
+	s.parsePmt(payload, true)
+
+	if s.videoPid != 0x101 || s.videoCodecId != base.RtmpCodecIdAvc {
+		t.Fatalf("video pid/codec mismatch. pid=%#x, codecId=%d", s.videoPid, s.videoCodecId)
+	}
+	if s.audioPid != 0x102 || s.audioCodecId != base.RtmpSoundFormatMp3 {
+		t.Fatalf("audio pid/codec mismatch. pid=%#x, codecId=%d", s.audioPid, s.audioCodecId)
+	}
+}
+
+func packTsPayloadPacket(payload []byte, pid uint16, pusi bool, cc uint8) []byte {
+	packet := make([]byte, tsPacketSize)
+	packet[0] = 0x47
+	var p byte
+	if pusi {
+		p = 0x40
+	}
+	packet[1] = p | byte(pid>>8)&0x1F
+	packet[2] = byte(pid)
+	// payload不足184字节时用adaptation field的stuffing_bytes补齐，填充字节不会混进payload
+	stuffing := tsPacketSize - 4 - len(payload)
+	if stuffing <= 0 {
+		packet[3] = 0x10 | (cc & 0xF) // 无adaptation field，payload_only
+		copy(packet[4:], payload)
+		return packet
+	}
+	packet[3] = 0x30 | (cc & 0xF)  // adaptation field + payload
+	packet[4] = byte(stuffing - 1) // adaptation_field_length
+	if stuffing > 1 {
+		packet[5] = 0x00 // adaptation field各flag均为0
+		for i := 6; i < 4+stuffing; i++ {
+			packet[i] = 0xFF
+		}
+	}
+	copy(packet[4+stuffing:], payload)
+	return packet
+}
+
+func packMp3Pes(pts uint64, mp3Payload []byte) []byte {
+	ptsBuf := packPesTimestamp(0x2, pts)
+
+	header := []byte{0x00, 0x00, 0x01, 0xC0, 0x00, 0x00, 0x80, 0x80, byte(len(ptsBuf))}
+	b := make([]byte, 0, len(header)+len(ptsBuf)+len(mp3Payload))
+	b = append(b, header...)
+	b = append(b, ptsBuf...)
+	b = append(b, mp3Payload...)
+	return b
+}
+
+// TestFeedTsPackets_Mp3AudioRoundTrip
+//
+// 喂入PMT（注册MP3音频）+两个MP3 PES包（第二个的pusi触发第一个出队），验证能正确拼出RTMP audio消息，
+// 且pts按90kHz->1kHz换算后写进了TimestampAbs
+//
+func TestFeedTsPackets_Mp3AudioRoundTrip(t *testing.T) {
+	observer := &testMpegts2RtmpObserver{}
+	s := NewMpegts2RtmpRemuxer(observer)
+
+	pmtPayload := buildPmtSectionPayload(pmtEsEntry{streamType: mpegts.StreamTypeMp3, pid: mpegts.PidAudio})
+	s.FeedTsPackets(packTsPayloadPacket(pmtPayload, mpegts.PidPmt, true, 0))
+
+	const pts1 = uint64(90000)
+	frame1 := []byte{0xFF, 0xFB, 0x90, 0x00, 'm', 'p', '3'}
+	s.FeedTsPackets(packTsPayloadPacket(packMp3Pes(pts1, frame1), mpegts.PidAudio, true, 0))
+
+	const pts2 = uint64(180000)
+	frame2 := []byte{0xFF, 0xFB, 0x90, 0x00, 'm', 'p', '3', '2'}
+	s.FeedTsPackets(packTsPayloadPacket(packMp3Pes(pts2, frame2), mpegts.PidAudio, true, 1))
+
+	if len(observer.msgs) != 1 {
+		t.Fatalf("expected exactly 1 rtmp msg after second pes flushes the first, got %d", len(observer.msgs))
+	}
+
+	msg := observer.msgs[0]
+	if msg.Header.MsgTypeId != base.RtmpTypeIdAudio {
+		t.Fatalf("msg type mismatch. got=%d", msg.Header.MsgTypeId)
+	}
+	if msg.Header.TimestampAbs != uint32(pts1/90) {
+		t.Fatalf("timestamp mismatch. got=%d, want=%d", msg.Header.TimestampAbs, pts1/90)
+	}
+	wantHeader := base.RtmpSoundFormatMp3 << 4
+	if msg.Payload[0] != wantHeader {
+		t.Fatalf("sound format header mismatch. got=%#x, want=%#x", msg.Payload[0], wantHeader)
+	}
+	if string(msg.Payload[1:]) != string(frame1) {
+		t.Fatalf("payload mismatch. got=%v, want=%v", msg.Payload[1:], frame1)
+	}
+}
@@ -0,0 +1,235 @@
+// Copyright 2020, Chef.  All rights reserved.
+// https://github.com/q191201771/lal
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package remux
+
+import (
+	"github.com/q191201771/lal/pkg/mpegts"
+	"github.com/q191201771/naza/pkg/bele"
+)
+
+// pmtEsEntry 待追加进PMT的一条elementary_stream描述
+//
+type pmtEsEntry struct {
+	streamType uint8
+	pid        uint16
+	descriptor []byte // 完整的descriptor()字节（tag+length+data），没有则传nil
+}
+
+// packPmtEsEntry 按PMT elementary_stream_descriptor的格式打包一条entry：
+// stream_type(8) + reserved(3)+elementary_PID(13) + reserved(4)+ES_info_length(12) + descriptor()
+//
+func packPmtEsEntry(e pmtEsEntry) []byte {
+	b := make([]byte, 0, 5+len(e.descriptor))
+	b = append(b, e.streamType)
+	b = append(b, byte(0xE0|(e.pid>>8)&0x1F), byte(e.pid))
+	var esInfoLengthBuf [2]byte
+	bele.BePutUint16(esInfoLengthBuf[:], uint16(len(e.descriptor))&0xFFF|0xF000)
+	b = append(b, esInfoLengthBuf[:]...)
+	b = append(b, e.descriptor...)
+	return b
+}
+
+// packRegistrationDescriptor registration_descriptor()，descriptor_tag=0x05，
+// 用于SCTE-35的"CUEI"标识，见SCTE-35标准及ISO/IEC 13818-1
+//
+func packRegistrationDescriptor(formatIdentifier string) []byte {
+	b := make([]byte, 0, 2+len(formatIdentifier))
+	b = append(b, 0x05, byte(len(formatIdentifier)))
+	b = append(b, formatIdentifier...)
+	return b
+}
+
+// patchPmtStreamType
+//
+// 原地替换PMT中指定PID对应elementary_stream_descriptor的stream_type字段，不改变section长度，
+// 只需要重新计算CRC32，用于filter按默认stream_type打包好PMT之后，根据实际探测到的编码格式纠正stream_type
+// （比如音频是G.711/MP3/LPCM而不是filter默认认为的AAC）
+//
+// 找不到PMT包或者找不到对应pid的entry时，原样返回
+//
+func patchPmtStreamType(b []byte, pid uint16, streamType uint8) []byte {
+	out := make([]byte, 0, len(b))
+	for i := 0; i+tsPacketSize <= len(b); i += tsPacketSize {
+		packet := b[i : i+tsPacketSize]
+		tsPid := uint16(packet[1]&0x1F)<<8 | uint16(packet[2])
+		if tsPid != mpegts.PidPmt {
+			out = append(out, packet...)
+			continue
+		}
+
+		newPacket := replacePmtStreamType(packet, pid, streamType)
+		if newPacket == nil {
+			out = append(out, packet...)
+			continue
+		}
+		out = append(out, newPacket...)
+	}
+	return out
+}
+
+// replacePmtStreamType 解析单个PMT ts包，返回一份修改了elementary stream循环中指定pid的stream_type字段的新包，
+// 不修改传入的packet
+//
+func replacePmtStreamType(packet []byte, pid uint16, streamType uint8) []byte {
+	pusi := packet[1]&0x40 != 0
+	if !pusi {
+		return nil
+	}
+
+	hasAdaptation := packet[3]&0x20 != 0
+	payloadStart := 4
+	if hasAdaptation {
+		if len(packet) <= 4 {
+			return nil
+		}
+		payloadStart = 5 + int(packet[4])
+	}
+	if payloadStart >= len(packet) {
+		return nil
+	}
+
+	newPacket := make([]byte, len(packet))
+	copy(newPacket, packet)
+
+	payload := newPacket[payloadStart:]
+
+	pointerField := int(payload[0])
+	if 1+pointerField >= len(payload) {
+		return nil
+	}
+	section := payload[1+pointerField:]
+	if len(section) < 12 {
+		return nil
+	}
+
+	sectionLength := int(section[1]&0xF)<<8 | int(section[2])
+	if 3+sectionLength > len(section) {
+		return nil
+	}
+	programInfoLength := int(section[10]&0xF)<<8 | int(section[11])
+	esLoopStart := 12 + programInfoLength
+	esLoopEnd := 3 + sectionLength - 4 // CRC32之前
+
+	found := false
+	i := esLoopStart
+	for i+5 <= esLoopEnd {
+		esPid := uint16(section[i+1]&0x1F)<<8 | uint16(section[i+2])
+		esInfoLength := int(section[i+3]&0xF)<<8 | int(section[i+4])
+		if esPid == pid {
+			section[i] = streamType
+			found = true
+			break
+		}
+		i += 5 + esInfoLength
+	}
+	if !found {
+		return nil
+	}
+
+	newHead := section[:esLoopEnd]
+	crc := crc32Mpeg(newHead)
+	bele.BePutUint32(section[esLoopEnd:esLoopEnd+4], crc)
+
+	return newPacket
+}
+
+// patchPmtAddEsEntries
+//
+// 往已经打包好的PAT+PMT ts包（onPatPmt回调传入的b）里，在PMT的elementary stream循环末尾追加新的entry，
+// 重新计算section_length和CRC32后，用packTsSection重新分片成ts包，替换掉原来的PMT包，PAT包保持不变
+//
+// 要求b中只有一个PMT分片包（filter正常情况下就是这样打包的），如果找不到PMT包，原样返回
+//
+func patchPmtAddEsEntries(b []byte, entries ...pmtEsEntry) []byte {
+	if len(entries) == 0 {
+		return b
+	}
+
+	var extra []byte
+	for _, e := range entries {
+		extra = append(extra, packPmtEsEntry(e)...)
+	}
+
+	out := make([]byte, 0, len(b)+len(extra)+tsPacketSize)
+	patched := false
+
+	for i := 0; i+tsPacketSize <= len(b); i += tsPacketSize {
+		packet := b[i : i+tsPacketSize]
+		pid := uint16(packet[1]&0x1F)<<8 | uint16(packet[2])
+		if pid != mpegts.PidPmt || patched {
+			out = append(out, packet...)
+			continue
+		}
+
+		newPmtPackets := patchPmtPacket(packet, extra)
+		if newPmtPackets == nil {
+			out = append(out, packet...)
+			continue
+		}
+		out = append(out, newPmtPackets...)
+		patched = true
+	}
+
+	return out
+}
+
+// patchPmtPacket 解析单个PMT ts包，在elementary stream循环末尾追加extra字节，返回重新打包后的ts包（一个或多个）
+//
+// 解析失败（不是pusi包、section在本包内不完整等非典型情况）时返回nil，调用方应该原样保留原始包
+//
+func patchPmtPacket(packet []byte, extra []byte) []byte {
+	pusi := packet[1]&0x40 != 0
+	if !pusi {
+		return nil
+	}
+
+	hasAdaptation := packet[3]&0x20 != 0
+	payloadStart := 4
+	if hasAdaptation {
+		if len(packet) <= 4 {
+			return nil
+		}
+		payloadStart = 5 + int(packet[4])
+	}
+	if payloadStart >= len(packet) {
+		return nil
+	}
+	payload := packet[payloadStart:]
+
+	pointerField := int(payload[0])
+	if 1+pointerField >= len(payload) {
+		return nil
+	}
+	section := payload[1+pointerField:]
+	if len(section) < 12 {
+		return nil
+	}
+
+	sectionLength := int(section[1]&0xF)<<8 | int(section[2])
+	if 3+sectionLength > len(section) {
+		return nil
+	}
+	// head：table_id到descriptor_loop末尾，即整个section去掉结尾4字节CRC32
+	head := section[:3+sectionLength-4]
+
+	newHead := make([]byte, 0, len(head)+len(extra))
+	newHead = append(newHead, head...)
+	newHead = append(newHead, extra...)
+
+	newSectionLength := len(newHead) - 3 + 4 // -3(table_id+section_length字段本身) +4(CRC32)
+	bele.BePutUint16(newHead[1:3], uint16(newSectionLength)&0xFFF|0x3000)
+
+	crc := crc32Mpeg(newHead)
+	var crcBuf [4]byte
+	bele.BePutUint32(crcBuf[:], crc)
+	newSection := append(newHead, crcBuf[:]...)
+
+	cc := packet[3] & 0xF
+	return packTsSection(newSection, mpegts.PidPmt, &cc)
+}
@@ -0,0 +1,118 @@
+// Copyright 2020, Chef.  All rights reserved.
+// https://github.com/q191201771/lal
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package remux
+
+import (
+	"testing"
+
+	"github.com/q191201771/lal/pkg/mpegts"
+	"github.com/q191201771/naza/pkg/bele"
+)
+
+// buildTestPmtPacket 拼一个只有一个音频entry（pid=mpegts.PidAudio, stream_type=AAC）的最小PMT包，用于测试
+//
+func buildTestPmtPacket() []byte {
+	// program_number(2) + reserved+version+current_next(1) + section_number(1) + last_section_number(1) +
+	// reserved+PCR_PID(2) + reserved+program_info_length(2)
+	head := []byte{
+		0x00, 0x01, // program_number
+		0xC1,       // version_number/current_next_indicator
+		0x00,       // section_number
+		0x00,       // last_section_number
+		0xE1, 0x00, // reserved+PCR_PID
+		0xF0, 0x00, // reserved+program_info_length=0
+	}
+	esEntry := packPmtEsEntry(pmtEsEntry{streamType: mpegts.StreamTypeAac, pid: mpegts.PidAudio})
+
+	body := append([]byte{}, head...)
+	body = append(body, esEntry...)
+
+	section := []byte{0x02} // table_id
+	sectionLength := 3 + len(body) + 4 - 3
+	var secLenBuf [2]byte
+	bele.BePutUint16(secLenBuf[:], uint16(sectionLength)&0xFFF|0x3000)
+	section = append(section, secLenBuf[:]...)
+	section = append(section, body...)
+
+	crc := crc32Mpeg(section)
+	var crcBuf [4]byte
+	bele.BePutUint32(crcBuf[:], crc)
+	section = append(section, crcBuf[:]...)
+
+	var cc uint8
+	return packTsSection(section, mpegts.PidPmt, &cc)
+}
+
+func parsePmtEsEntries(b []byte) (entries [][3]int) {
+	for i := 0; i+tsPacketSize <= len(b); i += tsPacketSize {
+		packet := b[i : i+tsPacketSize]
+		pid := uint16(packet[1]&0x1F)<<8 | uint16(packet[2])
+		if pid != mpegts.PidPmt {
+			continue
+		}
+		payload := packet[4:]
+		pointerField := int(payload[0])
+		section := payload[1+pointerField:]
+		sectionLength := int(section[1]&0xF)<<8 | int(section[2])
+		programInfoLength := int(section[10]&0xF)<<8 | int(section[11])
+		esLoopStart := 12 + programInfoLength
+		esLoopEnd := 3 + sectionLength - 4
+
+		j := esLoopStart
+		for j+5 <= esLoopEnd {
+			streamType := int(section[j])
+			esPid := int(section[j+1]&0x1F)<<8 | int(section[j+2])
+			esInfoLength := int(section[j+3]&0xF)<<8 | int(section[j+4])
+			entries = append(entries, [3]int{streamType, esPid, esInfoLength})
+			j += 5 + esInfoLength
+		}
+	}
+	return
+}
+
+func TestPatchPmtStreamType(t *testing.T) {
+	b := buildTestPmtPacket()
+
+	patched := patchPmtStreamType(b, mpegts.PidAudio, mpegts.StreamTypePcma)
+
+	entries := parsePmtEsEntries(patched)
+	if len(entries) != 1 {
+		t.Fatalf("es entry count mismatch. got=%d", len(entries))
+	}
+	if entries[0][0] != int(mpegts.StreamTypePcma) {
+		t.Fatalf("stream_type mismatch. got=%#x", entries[0][0])
+	}
+	if entries[0][1] != int(mpegts.PidAudio) {
+		t.Fatalf("pid mismatch. got=%#x", entries[0][1])
+	}
+}
+
+func TestPatchPmtAddEsEntries(t *testing.T) {
+	b := buildTestPmtPacket()
+
+	patched := patchPmtAddEsEntries(b,
+		pmtEsEntry{streamType: streamTypeTimedMetadata, pid: pidTimedMetadata},
+		pmtEsEntry{streamType: streamTypeScte35, pid: pidScte35, descriptor: packRegistrationDescriptor("CUEI")},
+	)
+
+	entries := parsePmtEsEntries(patched)
+	if len(entries) != 3 {
+		t.Fatalf("es entry count mismatch. got=%d", len(entries))
+	}
+
+	if entries[1][0] != int(streamTypeTimedMetadata) || entries[1][1] != int(pidTimedMetadata) {
+		t.Fatalf("id3 entry mismatch. got=%+v", entries[1])
+	}
+	if entries[2][0] != int(streamTypeScte35) || entries[2][1] != int(pidScte35) {
+		t.Fatalf("scte35 entry mismatch. got=%+v", entries[2])
+	}
+	if entries[2][2] != len(packRegistrationDescriptor("CUEI")) {
+		t.Fatalf("scte35 descriptor length mismatch. got=%d", entries[2][2])
+	}
+}
@@ -0,0 +1,344 @@
+// Copyright 2020, Chef.  All rights reserved.
+// https://github.com/q191201771/lal
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package remux
+
+import (
+	"github.com/q191201771/lal/pkg/aac"
+	"github.com/q191201771/lal/pkg/avc"
+	"github.com/q191201771/lal/pkg/base"
+	"github.com/q191201771/lal/pkg/hevc"
+	"github.com/q191201771/naza/pkg/bele"
+)
+
+// fmp4TrackIdVideo fmp4TrackIdAudio
+//
+// init segment中track_id固定分配，video=1，audio=2，与moof中tfhd.track_ID一一对应
+//
+const (
+	fmp4TrackIdVideo uint32 = 1
+	fmp4TrackIdAudio uint32 = 2
+
+	fmp4Timescale uint32 = 90000 // 统一使用90kHz时间基，与mpegts保持一致，方便TS/fMP4切片对齐
+)
+
+// Fmp4Frame 一个fmp4 sample对应的信息，moof/mdat均由此生成
+//
+type Fmp4Frame struct {
+	TrackId uint32
+	Pts     uint64
+	Dts     uint64
+	Cts     uint32 // 单位90kHz，即pts-dts
+	Key     bool
+	Raw     []byte // avcc/hvcc长度前缀nalu，或者一帧音频的裸数据
+}
+
+type Rtmp2Fmp4RemuxerObserver interface {
+	// OnInitSegment
+	//
+	// 只会回调一次：已经收到过消息的轨道（视频的sps/pps/vps、音频的seq header或编码信息）都就绪后回调，
+	// 发送时还没收到过消息的轨道不会出现在init segment中
+	//
+	// @param b: ftyp+moov
+	//
+	OnInitSegment(b []byte)
+
+	// OnMediaSegment
+	//
+	// @param b: styp+moof+mdat
+	//
+	// @param frame: 当前分片内唯一的那个sample（一个视频帧或一个音频帧）的信息，方便上层打日志、判断边界
+	//
+	// @param boundary: 是否是新的一个分片（CMAF chunk/segment）的起始点
+	//
+	OnMediaSegment(b []byte, frame *Fmp4Frame, boundary bool)
+}
+
+// Rtmp2Fmp4Remuxer 输入rtmp流，输出fmp4（ISO-BMFF）流，用于LL-HLS、DASH等场景
+//
+type Rtmp2Fmp4Remuxer struct {
+	UniqueKey string
+
+	observer Rtmp2Fmp4RemuxerObserver
+
+	videoOut []byte // avcc/hvcc，长度前缀nalu TODO chef: 优化这块buff
+
+	spspps       []byte // Annexb格式缓存，复用自Rtmp2MpegtsRemuxer同样的解析逻辑
+	vcc          []byte // avcC/hvcC payload，即AVCDecoderConfigurationRecord/HEVCDecoderConfigurationRecord原始内容
+	videoCodecId uint8  // base.RtmpCodecIdAvc/base.RtmpCodecIdHevc
+
+	ascCtx       *aac.AscContext
+	audioCodecId uint8 // base.RtmpSoundFormatXXX
+
+	sawVideo bool // 是否收到过视频消息，区分"没有视频轨"和"视频轨seq header还没就绪"
+	sawAudio bool // 是否收到过音频消息，同上
+
+	initSegmentSent bool
+	opened          bool
+
+	videoSeq uint32
+	audioSeq uint32
+
+	videoPrevDts    uint64 // 同轨道上一帧的dts，用于换算当前trun.sample_duration
+	hasVideoPrevDts bool
+	audioPrevDts    uint64
+	hasAudioPrevDts bool
+}
+
+func NewRtmp2Fmp4Remuxer(observer Rtmp2Fmp4RemuxerObserver) *Rtmp2Fmp4Remuxer {
+	return &Rtmp2Fmp4Remuxer{
+		UniqueKey: base.GenUkRtmp2MpegtsRemuxer(),
+		observer:  observer,
+		videoOut:  make([]byte, 0, 1024*1024),
+	}
+}
+
+// FeedRtmpMessage
+//
+// @param msg: msg.Payload 调用结束后，函数内部不会持有这块内存
+//
+func (s *Rtmp2Fmp4Remuxer) FeedRtmpMessage(msg base.RtmpMsg) {
+	switch msg.Header.MsgTypeId {
+	case base.RtmpTypeIdAudio:
+		s.feedAudio(msg)
+	case base.RtmpTypeIdVideo:
+		s.feedVideo(msg)
+	}
+}
+
+func (s *Rtmp2Fmp4Remuxer) VideoSeqHeaderCached() bool {
+	return s.vcc != nil
+}
+
+func (s *Rtmp2Fmp4Remuxer) AudioSeqHeaderCached() bool {
+	switch s.audioCodecId {
+	case base.RtmpSoundFormatAac:
+		return s.ascCtx != nil
+	case base.RtmpSoundFormatG711A, base.RtmpSoundFormatG711U, base.RtmpSoundFormatMp3, base.RtmpSoundFormatMp38k, base.RtmpSoundFormatLinearPcm, base.RtmpSoundFormatLinearPcmLe:
+		return true
+	default:
+		return false
+	}
+}
+
+// ----- private -------------------------------------------------------------------------------------------------------
+
+func (s *Rtmp2Fmp4Remuxer) feedVideo(msg base.RtmpMsg) {
+	s.sawVideo = true
+
+	if len(msg.Payload) <= 5 {
+		Log.Errorf("[%s] invalid video message length. header=%+v", s.UniqueKey, msg.Header)
+		return
+	}
+
+	codecId := msg.Payload[0] & 0xF
+	if codecId != base.RtmpCodecIdAvc && codecId != base.RtmpCodecIdHevc {
+		return
+	}
+	s.videoCodecId = codecId
+
+	var err error
+	if msg.IsAvcKeySeqHeader() {
+		if s.spspps, err = avc.SpsPpsSeqHeader2Annexb(msg.Payload); err != nil {
+			Log.Errorf("[%s] cache spspps failed. err=%+v", s.UniqueKey, err)
+			return
+		}
+		// AVCDecoderConfigurationRecord紧跟在5字节的FLV video tag头之后，可以直接作为avcC box的payload使用
+		s.vcc = append([]byte(nil), msg.Payload[5:]...)
+		s.maybeSendInitSegment()
+		return
+	} else if msg.IsHevcKeySeqHeader() {
+		if s.spspps, err = hevc.VpsSpsPpsSeqHeader2Annexb(msg.Payload); err != nil {
+			Log.Errorf("[%s] cache vpsspspps failed. err=%+v", s.UniqueKey, err)
+			return
+		}
+		// HEVCDecoderConfigurationRecord同理
+		s.vcc = append([]byte(nil), msg.Payload[5:]...)
+		s.maybeSendInitSegment()
+		return
+	}
+
+	if !s.VideoSeqHeaderCached() {
+		Log.Warnf("[%s] feed video message but seq header not exist.", s.UniqueKey)
+		return
+	}
+
+	cts := bele.BeUint24(msg.Payload[2:])
+
+	// fmp4保留avcc/hvcc的长度前缀格式，不需要像mpegts那样转换成Annexb，直接逐个nalu拷贝即可
+	nals, err := avc.SplitNaluAvcc(msg.Payload[5:])
+	if err != nil {
+		Log.Errorf("[%s] iterate nalu failed. err=%+v, header=%+v", err, s.UniqueKey, msg.Header)
+		return
+	}
+
+	out := s.videoOut[0:0]
+	for _, nal := range nals {
+		var lenBuf [4]byte
+		bele.BePutUint32(lenBuf[:], uint32(len(nal)))
+		out = append(out, lenBuf[:]...)
+		out = append(out, nal...)
+	}
+
+	dts := uint64(msg.Header.TimestampAbs) * 90
+
+	frame := Fmp4Frame{
+		TrackId: fmp4TrackIdVideo,
+		Dts:     dts,
+		Pts:     dts + uint64(cts)*90,
+		Cts:     cts * 90,
+		Key:     msg.IsVideoKeyNalu(),
+		Raw:     out,
+	}
+
+	s.onFrame(&frame)
+}
+
+func (s *Rtmp2Fmp4Remuxer) feedAudio(msg base.RtmpMsg) {
+	s.sawAudio = true
+
+	if len(msg.Payload) < 1 {
+		Log.Errorf("[%s] invalid audio message length. len=%d", s.UniqueKey, len(msg.Payload))
+		return
+	}
+
+	soundFormat := msg.Payload[0] >> 4
+	s.audioCodecId = soundFormat
+
+	var raw []byte
+	dts := uint64(msg.Header.TimestampAbs) * 90
+
+	switch soundFormat {
+	case base.RtmpSoundFormatAac:
+		if len(msg.Payload) < 3 {
+			return
+		}
+		if msg.Payload[1] == base.RtmpAacPacketTypeSeqHeader {
+			var err error
+			if s.ascCtx, err = aac.NewAscContext(msg.Payload[2:]); err != nil {
+				Log.Errorf("[%s] cache aac seq header failed. err=%+v", s.UniqueKey, err)
+			}
+			s.maybeSendInitSegment()
+			return
+		}
+		if !s.AudioSeqHeaderCached() {
+			Log.Warnf("[%s] feed audio message but aac seq header not exist.", s.UniqueKey)
+			return
+		}
+		raw = msg.Payload[2:]
+	case base.RtmpSoundFormatMp3, base.RtmpSoundFormatMp38k, base.RtmpSoundFormatG711A, base.RtmpSoundFormatG711U,
+		base.RtmpSoundFormatLinearPcm, base.RtmpSoundFormatLinearPcmLe:
+		// 这些格式没有单独的seq header，首个音频包到达后即可建立init segment
+		s.maybeSendInitSegment()
+		raw = msg.Payload[1:]
+	default:
+		return
+	}
+
+	frame := Fmp4Frame{
+		TrackId: fmp4TrackIdAudio,
+		Dts:     dts,
+		Pts:     dts,
+		Key:     false,
+		Raw:     raw,
+	}
+
+	s.onFrame(&frame)
+}
+
+// maybeSendInitSegment
+//
+// 只对实际存在的轨道等待其seq header就绪，不要求一定同时有音视频：
+// 纯视频源（没有收到过音频消息）不等待音频ASC，纯音频源同理不等待视频sps/pps/vps，
+// 这样才能支持Rtmp2MpegtsRemuxer已经支持的视频only/音频only场景
+//
+func (s *Rtmp2Fmp4Remuxer) maybeSendInitSegment() {
+	if s.initSegmentSent {
+		return
+	}
+	if !s.sawVideo && !s.sawAudio {
+		return
+	}
+	if s.sawVideo && !s.VideoSeqHeaderCached() {
+		return
+	}
+	if s.sawAudio && !s.AudioSeqHeaderCached() {
+		return
+	}
+
+	b := s.packInitSegment()
+	s.initSegmentSent = true
+	s.observer.OnInitSegment(b)
+}
+
+// Rtmp2FmpBoundary
+//
+// 视频关键帧 && (没有音频 || 音频seq header已缓存)，音频帧从不作为边界。
+// 与Rtmp2MpegtsRemuxer.onFrame不同，这里不检查音频缓存是否为空，纯音频流也不会产生边界，
+// 因此TS和fMP4两种输出的分段点不保证一致
+//
+func (s *Rtmp2Fmp4Remuxer) Rtmp2FmpBoundary(frame *Fmp4Frame) bool {
+	if frame.TrackId != fmp4TrackIdVideo {
+		return false
+	}
+	return frame.Key && (!s.sawAudio || s.AudioSeqHeaderCached())
+}
+
+func (s *Rtmp2Fmp4Remuxer) onFrame(frame *Fmp4Frame) {
+	if !s.initSegmentSent {
+		// init segment还没发送出去之前，丢弃媒体数据，等待seq header到齐
+		return
+	}
+
+	boundary := s.Rtmp2FmpBoundary(frame)
+	if boundary {
+		s.opened = true
+	}
+
+	b := s.packMediaSegment(frame, boundary)
+	s.observer.OnMediaSegment(b, frame, boundary)
+}
+
+// packInitSegment packMediaSegment
+//
+// box的具体拼装（ftyp/moov/moof/mdat等）见fmp4box.go
+//
+func (s *Rtmp2Fmp4Remuxer) packInitSegment() []byte {
+	return packFmp4InitSegment(fmp4InitSegmentInfo{
+		videoCodecId: s.videoCodecId,
+		vcc:          s.vcc,
+		ascCtx:       s.ascCtx,
+		audioCodecId: s.audioCodecId,
+	})
+}
+
+// packMediaSegment
+//
+// trun.sample_duration取自同一条轨道上、当前帧与上一帧dts之差；第一帧没有可比较的上一帧，
+// 用packFmp4Trex里同样的兜底值（fmp4Timescale/25），避免sample_duration=0被Chrome/hls.js等MSE实现拒绝
+//
+func (s *Rtmp2Fmp4Remuxer) packMediaSegment(frame *Fmp4Frame, boundary bool) []byte {
+	var seq *uint32
+	var prevDts *uint64
+	var hasPrevDts *bool
+	if frame.TrackId == fmp4TrackIdVideo {
+		seq, prevDts, hasPrevDts = &s.videoSeq, &s.videoPrevDts, &s.hasVideoPrevDts
+	} else {
+		seq, prevDts, hasPrevDts = &s.audioSeq, &s.audioPrevDts, &s.hasAudioPrevDts
+	}
+
+	duration := fmp4Timescale / 25
+	if *hasPrevDts && frame.Dts > *prevDts {
+		duration = uint32(frame.Dts - *prevDts)
+	}
+	*prevDts = frame.Dts
+	*hasPrevDts = true
+
+	*seq++
+	return packFmp4MediaSegment(frame, *seq, duration, boundary)
+}
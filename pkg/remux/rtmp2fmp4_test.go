@@ -0,0 +1,112 @@
+// Copyright 2020, Chef.  All rights reserved.
+// https://github.com/q191201771/lal
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package remux
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/q191201771/lal/pkg/base"
+	"github.com/q191201771/naza/pkg/bele"
+)
+
+type testRtmp2Fmp4Observer struct {
+	initSegmentCount int
+	mediaSegments    [][]byte
+}
+
+func (o *testRtmp2Fmp4Observer) OnInitSegment(b []byte) {
+	o.initSegmentCount++
+}
+
+func (o *testRtmp2Fmp4Observer) OnMediaSegment(b []byte, frame *Fmp4Frame, boundary bool) {
+	o.mediaSegments = append(o.mediaSegments, b)
+}
+
+// TestMaybeSendInitSegment_VideoOnly 纯视频源（没有音频消息）不应该等待音频seq header
+//
+func TestMaybeSendInitSegment_VideoOnly(t *testing.T) {
+	observer := &testRtmp2Fmp4Observer{}
+	s := NewRtmp2Fmp4Remuxer(observer)
+
+	s.sawVideo = true
+	s.videoCodecId = base.RtmpCodecIdAvc
+	s.vcc = []byte{0x01, 0x42, 0x00, 0x1E}
+
+	s.maybeSendInitSegment()
+
+	if observer.initSegmentCount != 1 {
+		t.Fatalf("expected init segment to be sent for video-only source, got count=%d", observer.initSegmentCount)
+	}
+}
+
+// TestMaybeSendInitSegment_AudioOnly 纯音频源（没有视频消息）不应该等待视频seq header，
+// 同时覆盖没有独立seq header的编码格式（G.711）只要codec id确定了就算ready
+//
+func TestMaybeSendInitSegment_AudioOnly(t *testing.T) {
+	observer := &testRtmp2Fmp4Observer{}
+	s := NewRtmp2Fmp4Remuxer(observer)
+
+	s.sawAudio = true
+	s.audioCodecId = base.RtmpSoundFormatG711A
+
+	s.maybeSendInitSegment()
+
+	if observer.initSegmentCount != 1 {
+		t.Fatalf("expected init segment to be sent for audio-only source, got count=%d", observer.initSegmentCount)
+	}
+}
+
+// TestMaybeSendInitSegment_WaitsForMissingTrack 音视频都出现过时，必须等两条轨道都ready才发送
+//
+func TestMaybeSendInitSegment_WaitsForMissingTrack(t *testing.T) {
+	observer := &testRtmp2Fmp4Observer{}
+	s := NewRtmp2Fmp4Remuxer(observer)
+
+	s.sawVideo = true
+	s.videoCodecId = base.RtmpCodecIdAvc
+	s.vcc = []byte{0x01, 0x42, 0x00, 0x1E}
+	s.sawAudio = true
+	s.audioCodecId = base.RtmpSoundFormatAac
+	// ascCtx故意不设置，AAC音频没有seq header之前不算ready
+
+	s.maybeSendInitSegment()
+
+	if observer.initSegmentCount != 0 {
+		t.Fatalf("expected init segment withheld until aac asc is cached, got count=%d", observer.initSegmentCount)
+	}
+}
+
+// TestPackMediaSegment_FirstSampleDurationFallback
+//
+// 同一条轨道的第一个sample没有上一帧dts可供换算，应该使用trex同款的兜底duration(fmp4Timescale/25)，
+// 而不是0；第二个sample则应该用两帧dts之差算出真实duration
+//
+func TestPackMediaSegment_FirstSampleDurationFallback(t *testing.T) {
+	observer := &testRtmp2Fmp4Observer{}
+	s := NewRtmp2Fmp4Remuxer(observer)
+
+	frame1 := &Fmp4Frame{TrackId: fmp4TrackIdVideo, Dts: 90000, Key: true, Raw: []byte{0, 0, 0, 1, 0x65}}
+	b1 := s.packMediaSegment(frame1, true)
+	if gotDuration(b1) != fmp4Timescale/25 {
+		t.Fatalf("first sample duration mismatch. got=%d, want=%d", gotDuration(b1), fmp4Timescale/25)
+	}
+
+	frame2 := &Fmp4Frame{TrackId: fmp4TrackIdVideo, Dts: 93000, Key: false, Raw: []byte{0, 0, 0, 1, 0x41}}
+	b2 := s.packMediaSegment(frame2, false)
+	if gotDuration(b2) != 3000 {
+		t.Fatalf("second sample duration mismatch. got=%d, want=3000", gotDuration(b2))
+	}
+}
+
+func gotDuration(mediaSegment []byte) uint32 {
+	idx := bytes.Index(mediaSegment, []byte("trun"))
+	durationPos := idx + 4 + 4 + 4 + 4 // "trun"+flags(4)+sample_count(4)+data_offset(4) -> duration字段起始
+	return bele.BeUint32(mediaSegment[durationPos : durationPos+4])
+}
@@ -9,6 +9,7 @@
 package remux
 
 import (
+	"bytes"
 	"encoding/hex"
 	"github.com/q191201771/lal/pkg/aac"
 	"github.com/q191201771/lal/pkg/avc"
@@ -23,6 +24,15 @@ var calcFragmentHeaderQueueSize = 16
 var maxAudioCacheDelayByAudio uint64 = 150 * 90 // 单位（毫秒*90）
 var maxAudioCacheDelayByVideo uint64 = 300 * 90 // 单位（毫秒*90）
 
+// pidTimedMetadata streamTypeTimedMetadata
+//
+// ID3 timed metadata使用的固定PID和PMT stream_type（"Metadata carried in PES packets"）
+//
+const (
+	pidTimedMetadata        uint16 = 0x102
+	streamTypeTimedMetadata uint8  = 0x15
+)
+
 type Rtmp2MpegtsRemuxerObserver interface {
 	// OnPatPmt
 	//
@@ -37,6 +47,24 @@ type Rtmp2MpegtsRemuxerObserver interface {
 	// @param frame: 各字段含义见 mpegts.Frame 结构体定义
 	//
 	OnTsPackets(tsPackets []byte, frame *mpegts.Frame, boundary bool)
+
+	// OnTimedMetadataPes
+	//
+	// ID3 timed metadata对应的PES，携带在独立的PID（见 pidTimedMetadata）上，不计入音视频boundary的判断
+	//
+	// @param tsPackets: mpegts数据，有一个或多个188字节的ts数据组成
+	//
+	OnTimedMetadataPes(tsPackets []byte)
+
+	// OnScte35Section
+	//
+	// SCTE-35 splice_info_section对应的TS section（PID见 pidScte35），不是PES，没有PES头
+	//
+	// @param tsPackets: mpegts数据，有一个或多个188字节的ts数据组成
+	//
+	// @param cmd, pts: 本次插入时传入的splice command及其pts，方便上层生成#EXT-X-CUE-OUT/#EXT-X-DATERANGE
+	//
+	OnScte35Section(tsPackets []byte, cmd Scte35Command, pts uint64)
 }
 
 // Rtmp2MpegtsRemuxer 输入rtmp流，输出mpegts流
@@ -49,10 +77,18 @@ type Rtmp2MpegtsRemuxer struct {
 	videoOut                []byte // Annexb TODO chef: 优化这块buff
 	spspps                  []byte // Annexb 也可能是vps+sps+pps
 	ascCtx                  *aac.AscContext
+	audioCodecId            uint8  // base.RtmpSoundFormatXXX，每个受支持的音频包到达时按其SoundFormat更新
 	audioCacheFrames        []byte // 缓存音频帧数据，注意，可能包含多个音频帧 TODO chef: 优化这块buff
 	audioCacheFirstFramePts uint64 // audioCacheFrames中第一个音频帧的时间戳 TODO chef: rename to DTS
 	audioCc                 uint8
 	videoCc                 uint8
+	timedMetadataCc         uint8
+
+	pendingId3    []byte // 等待在下一个boundary发送的ID3 PES payload，nil表示没有待发送的cue
+	pendingId3Pts uint64
+
+	scte35Cc              uint8
+	pendingScte35Boundary bool // InsertScte35调用后置位，强制下一个视频帧成为分片边界，使切片与splice点对齐
 
 	opened bool
 }
@@ -80,6 +116,65 @@ func (s *Rtmp2MpegtsRemuxer) FeedRtmpMessage(msg base.RtmpMsg) {
 
 // ---------------------------------------------------------------------------------------------------------------------
 
+// FeedTimedMetadata
+//
+// 喂入一段已经打包好的ID3v2 frame数据（例如调用方自己拼好的PRIV/TXXX frame），
+// 内部会包一层ID3v2 tag头，缓存起来，在下一次HLS分片边界（boundary）那一帧数据之前插入，
+// 从而保证播放器从分片起始点播放/seek时一定能看到这个cue，不会被漏掉
+//
+// @param pts: 90kHz时间基
+//
+func (s *Rtmp2MpegtsRemuxer) FeedTimedMetadata(pts uint64, id3Frame []byte) {
+	s.pendingId3 = packId3Tag(id3Frame)
+	s.pendingId3Pts = pts
+}
+
+// flushTimedMetadataIfNeeded 在boundary到来时，把缓存的ID3 PES插在音视频帧之前发送出去
+//
+func (s *Rtmp2MpegtsRemuxer) flushTimedMetadataIfNeeded() {
+	if s.pendingId3 == nil {
+		return
+	}
+
+	var frame mpegts.Frame
+	frame.Cc = s.timedMetadataCc
+	frame.Dts = s.pendingId3Pts
+	frame.Pts = s.pendingId3Pts
+	frame.Key = false
+	frame.Raw = s.pendingId3
+	frame.Pid = pidTimedMetadata
+	frame.Sid = mpegts.StreamIdPrivateStream1
+
+	s.pendingId3 = nil
+
+	var packets []byte
+	mpegts.PackTsPacket(&frame, func(packet []byte) {
+		packets = append(packets, packet...)
+	})
+	s.timedMetadataCc = frame.Cc
+
+	s.observer.OnTimedMetadataPes(packets)
+}
+
+// feedMetadata
+//
+// 处理RTMP的AMF元数据消息：
+// - onMetaData、@setDataFrame：转换成携带节目信息的ID3 TXXX frame，方便HLS播放器（如Safari/hls.js）展示
+// - onCuePoint、onFCSubscribe：一些编码器（Wowza、OBS+插件）会用这两个AMF数据消息携带SCTE-35广告标记信息，
+//   转换成一次time_signal类型的SCTE-35插入，驱动HLS/CMAF打包器切出#EXT-X-CUE-OUT分片
+//
+func (s *Rtmp2MpegtsRemuxer) feedMetadata(msg base.RtmpMsg) {
+	pts := uint64(msg.Header.TimestampAbs) * 90
+
+	if bytes.Contains(msg.Payload, []byte("onCuePoint")) || bytes.Contains(msg.Payload, []byte("onFCSubscribe")) {
+		s.InsertScte35(Scte35Command{Type: Scte35CommandTypeTimeSignal}, pts)
+		return
+	}
+
+	txxx := packId3TxxxFrame("onMetaData", hex.EncodeToString(msg.Payload))
+	s.FeedTimedMetadata(pts, txxx)
+}
+
 // FlushAudio
 //
 // 吐出音频数据的三种情况：
@@ -99,7 +194,7 @@ func (s *Rtmp2MpegtsRemuxer) FlushAudio() {
 	frame.Key = false
 	frame.Raw = s.audioCacheFrames
 	frame.Pid = mpegts.PidAudio
-	frame.Sid = mpegts.StreamIdAudio
+	frame.Sid, frame.StreamType = s.audioSidAndStreamType()
 
 	// 注意，在回调前设置为nil，因为回调中有可能再次调用FlushAudio
 	s.audioCacheFrames = nil
@@ -109,8 +204,21 @@ func (s *Rtmp2MpegtsRemuxer) FlushAudio() {
 	s.audioCc = frame.Cc
 }
 
+// AudioSeqHeaderCached
+//
+// 对于AAC，需要收到过音频seq header才算ready
+// 对于G711（PCMA/PCMU）、MP3、LPCM，这些格式没有单独的seq header，只要确定了音频编码类型就算ready
+//
 func (s *Rtmp2MpegtsRemuxer) AudioSeqHeaderCached() bool {
-	return s.ascCtx != nil
+	switch s.audioCodecId {
+	case base.RtmpSoundFormatAac:
+		return s.ascCtx != nil
+	case base.RtmpSoundFormatG711A, base.RtmpSoundFormatG711U, base.RtmpSoundFormatMp3, base.RtmpSoundFormatMp38k,
+		base.RtmpSoundFormatLinearPcm, base.RtmpSoundFormatLinearPcmLe:
+		return true
+	default:
+		return false
+	}
 }
 
 func (s *Rtmp2MpegtsRemuxer) VideoSeqHeaderCached() bool {
@@ -128,6 +236,21 @@ func (s *Rtmp2MpegtsRemuxer) AudioCacheEmpty() bool {
 // 实现 rtmp2MpegtsFilterObserver
 //
 func (s *Rtmp2MpegtsRemuxer) onPatPmt(b []byte) {
+	// filter打包PMT时按AAC生成音频entry的默认stream_type，如果实际探测到的音频编码是G.711/MP3/LPCM，
+	// 需要把PMT里登记的stream_type纠正过来，否则播放器仍然会把该PID当作AAC解析
+	if s.audioCodecId != 0 && s.audioCodecId != base.RtmpSoundFormatAac {
+		_, streamType := s.audioSidAndStreamType()
+		b = patchPmtStreamType(b, mpegts.PidAudio, streamType)
+	}
+
+	// ID3 timed metadata固定携带在独立的PID上，需要登记进PMT，播放器才能发现并订阅该PES
+	// SCTE-35 splice_info_section同样登记在固定PID上，并按惯例携带一个format_identifier="CUEI"的
+	// registration_descriptor，供广告插入系统识别这是SCTE-35数据
+	b = patchPmtAddEsEntries(b,
+		pmtEsEntry{streamType: streamTypeTimedMetadata, pid: pidTimedMetadata},
+		pmtEsEntry{streamType: streamTypeScte35, pid: pidScte35, descriptor: packRegistrationDescriptor("CUEI")},
+	)
+
 	s.observer.OnPatPmt(b)
 }
 
@@ -137,6 +260,8 @@ func (s *Rtmp2MpegtsRemuxer) onPop(msg base.RtmpMsg) {
 		s.feedAudio(msg)
 	case base.RtmpTypeIdVideo:
 		s.feedVideo(msg)
+	case base.RtmpTypeIdMetadata:
+		s.feedMetadata(msg)
 	}
 }
 
@@ -280,14 +405,34 @@ func (s *Rtmp2MpegtsRemuxer) feedVideo(msg base.RtmpMsg) {
 }
 
 func (s *Rtmp2MpegtsRemuxer) feedAudio(msg base.RtmpMsg) {
-	if len(msg.Payload) < 3 {
+	if len(msg.Payload) < 1 {
 		Log.Errorf("[%s] invalid audio message length. len=%d", s.UniqueKey, len(msg.Payload))
 		return
 	}
-	if msg.Payload[0]>>4 != base.RtmpSoundFormatAac {
+
+	soundFormat := msg.Payload[0] >> 4
+	switch soundFormat {
+	case base.RtmpSoundFormatAac:
+		s.feedAudioAac(msg)
+	case base.RtmpSoundFormatMp3, base.RtmpSoundFormatMp38k:
+		s.feedAudioMp3(msg, soundFormat)
+	case base.RtmpSoundFormatG711A, base.RtmpSoundFormatG711U:
+		s.feedAudioG711(msg, soundFormat)
+	case base.RtmpSoundFormatLinearPcm, base.RtmpSoundFormatLinearPcmLe:
+		s.feedAudioLpcm(msg, soundFormat)
+	default:
+		// 其他格式（ADPCM、Nellymoser、Speex等）暂不支持转封装，直接丢弃
+	}
+}
+
+func (s *Rtmp2MpegtsRemuxer) feedAudioAac(msg base.RtmpMsg) {
+	if len(msg.Payload) < 3 {
+		Log.Errorf("[%s] invalid aac audio message length. len=%d", s.UniqueKey, len(msg.Payload))
 		return
 	}
 
+	s.audioCodecId = base.RtmpSoundFormatAac
+
 	//Log.Debugf("[%s] hls: feedAudio. dts=%d len=%d", s.UniqueKey, msg.Header.TimestampAbs, len(msg.Payload))
 
 	if msg.Payload[1] == base.RtmpAacPacketTypeSeqHeader {
@@ -303,7 +448,54 @@ func (s *Rtmp2MpegtsRemuxer) feedAudio(msg base.RtmpMsg) {
 	}
 
 	pts := uint64(msg.Header.TimestampAbs) * 90
+	s.flushAudioIfNeeded(pts)
+
+	adtsHeader := s.ascCtx.PackAdtsHeader(int(msg.Header.MsgLen - 2))
+	s.audioCacheFrames = append(s.audioCacheFrames, adtsHeader...)
+	s.audioCacheFrames = append(s.audioCacheFrames, msg.Payload[2:]...)
+}
+
+// feedAudioMp3
+//
+// MP3没有独立的seq header，裸流即可直接作为TS的ES
+//
+func (s *Rtmp2MpegtsRemuxer) feedAudioMp3(msg base.RtmpMsg, soundFormat uint8) {
+	s.audioCodecId = soundFormat
+
+	pts := uint64(msg.Header.TimestampAbs) * 90
+	s.flushAudioIfNeeded(pts)
+
+	s.audioCacheFrames = append(s.audioCacheFrames, msg.Payload[1:]...)
+}
+
+// feedAudioG711
+//
+// G.711（PCMA/PCMU）同样没有独立的seq header，原始payload（去掉1字节音频tag头）即是裸PCM编码数据
+//
+func (s *Rtmp2MpegtsRemuxer) feedAudioG711(msg base.RtmpMsg, soundFormat uint8) {
+	s.audioCodecId = soundFormat
 
+	pts := uint64(msg.Header.TimestampAbs) * 90
+	s.flushAudioIfNeeded(pts)
+
+	s.audioCacheFrames = append(s.audioCacheFrames, msg.Payload[1:]...)
+}
+
+// feedAudioLpcm
+//
+// LPCM的采样率、采样位宽、声道数都编码在音频tag头的低4bit中（SoundRate/SoundSize/SoundType），
+// 这里去掉1字节音频tag头后把PCM采样原样写入ES：不做格式换算，也不写入描述这些参数的LPCM私有头
+//
+func (s *Rtmp2MpegtsRemuxer) feedAudioLpcm(msg base.RtmpMsg, soundFormat uint8) {
+	s.audioCodecId = soundFormat
+
+	pts := uint64(msg.Header.TimestampAbs) * 90
+	s.flushAudioIfNeeded(pts)
+
+	s.audioCacheFrames = append(s.audioCacheFrames, msg.Payload[1:]...)
+}
+
+func (s *Rtmp2MpegtsRemuxer) flushAudioIfNeeded(pts uint64) {
 	if s.audioCacheFrames != nil && s.audioCacheFirstFramePts+maxAudioCacheDelayByAudio < pts {
 		s.FlushAudio()
 	}
@@ -311,10 +503,6 @@ func (s *Rtmp2MpegtsRemuxer) feedAudio(msg base.RtmpMsg) {
 	if s.audioCacheFrames == nil {
 		s.audioCacheFirstFramePts = pts
 	}
-
-	adtsHeader := s.ascCtx.PackAdtsHeader(int(msg.Header.MsgLen - 2))
-	s.audioCacheFrames = append(s.audioCacheFrames, adtsHeader...)
-	s.audioCacheFrames = append(s.audioCacheFrames, msg.Payload[2:]...)
 }
 
 func (s *Rtmp2MpegtsRemuxer) cacheAacSeqHeader(msg base.RtmpMsg) error {
@@ -323,6 +511,30 @@ func (s *Rtmp2MpegtsRemuxer) cacheAacSeqHeader(msg base.RtmpMsg) error {
 	return err
 }
 
+// audioSidAndStreamType
+//
+// 根据当前音频编码格式，返回PES封装使用的stream_id，以及PMT中登记的stream_type
+//
+// AAC/MP3使用标准的MPEG音频stream_id(0xC0)，PMT stream_type分别为0x0F/0x03
+// G.711（PCMA/PCMU）没有MPEG-TS标准stream_type，使用private_stream_1(0xBD)封装，
+// PMT stream_type使用私有标记（PCMA为0x90，PCMU为0x91），onPatPmt只替换该entry的stream_type，不附加descriptor
+// LPCM同样没有标准stream_type，复用private_stream_1封装，PMT stream_type使用私有标记
+//
+func (s *Rtmp2MpegtsRemuxer) audioSidAndStreamType() (sid uint8, streamType uint8) {
+	switch s.audioCodecId {
+	case base.RtmpSoundFormatMp3, base.RtmpSoundFormatMp38k:
+		return mpegts.StreamIdAudio, mpegts.StreamTypeMp3
+	case base.RtmpSoundFormatG711A:
+		return mpegts.StreamIdPrivateStream1, mpegts.StreamTypePcma
+	case base.RtmpSoundFormatG711U:
+		return mpegts.StreamIdPrivateStream1, mpegts.StreamTypePcmu
+	case base.RtmpSoundFormatLinearPcm, base.RtmpSoundFormatLinearPcmLe:
+		return mpegts.StreamIdPrivateStream1, mpegts.StreamTypeLpcm
+	default:
+		return mpegts.StreamIdAudio, mpegts.StreamTypeAac
+	}
+}
+
 func (s *Rtmp2MpegtsRemuxer) appendSpsPps(out []byte) ([]byte, error) {
 	if s.spspps == nil {
 		return out, base.ErrHls
@@ -347,10 +559,18 @@ func (s *Rtmp2MpegtsRemuxer) onFrame(frame *mpegts.Frame) {
 		//  (收到过音频seq header && fragment已经打开 && 音频缓存数据不为空) 说明 为什么音频缓存需不为空？
 		// )
 		boundary = frame.Key && (!s.AudioSeqHeaderCached() || !s.opened || !s.AudioCacheEmpty())
+
+		// 有未消费的SCTE-35插入点时，强制在下一个视频帧处切片，使分片边界与splice点对齐
+		if s.pendingScte35Boundary && frame.Pid == mpegts.PidVideo {
+			boundary = true
+			s.pendingScte35Boundary = false
+		}
 	}
 
 	if boundary {
 		s.opened = true
+		// 确保ID3 cue出现在新分片的第一帧数据之前，这样即使播放器从分片起始点seek也不会错过
+		s.flushTimedMetadataIfNeeded()
 	}
 
 	var packets []byte // TODO(chef): [refactor]
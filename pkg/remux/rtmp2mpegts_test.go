@@ -0,0 +1,37 @@
+// Copyright 2020, Chef.  All rights reserved.
+// https://github.com/q191201771/lal
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package remux
+
+import (
+	"testing"
+
+	"github.com/q191201771/lal/pkg/base"
+)
+
+// TestAudioSeqHeaderCached_AllNonAacFormats 覆盖所有没有独立seq header的音频格式，
+// 包括容易漏掉的MP3 8kHz（SoundFormat 14）和Linear PCM little-endian（SoundFormat 3）
+//
+func TestAudioSeqHeaderCached_AllNonAacFormats(t *testing.T) {
+	formats := []uint8{
+		base.RtmpSoundFormatG711A,
+		base.RtmpSoundFormatG711U,
+		base.RtmpSoundFormatMp3,
+		base.RtmpSoundFormatMp38k,
+		base.RtmpSoundFormatLinearPcm,
+		base.RtmpSoundFormatLinearPcmLe,
+	}
+
+	for _, f := range formats {
+		s := NewRtmp2MpegtsRemuxer(nil)
+		s.audioCodecId = f
+		if !s.AudioSeqHeaderCached() {
+			t.Errorf("expected AudioSeqHeaderCached() to be true for soundFormat=%d", f)
+		}
+	}
+}
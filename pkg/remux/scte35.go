@@ -0,0 +1,233 @@
+// Copyright 2020, Chef.  All rights reserved.
+// https://github.com/q191201771/lal
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package remux
+
+import (
+	"github.com/q191201771/naza/pkg/bele"
+)
+
+// pidScte35 streamTypeScte35
+//
+// SCTE-35 splice_info_section使用的固定PID和PMT stream_type
+//
+const (
+	pidScte35        uint16 = 0x1FC
+	streamTypeScte35 uint8  = 0x86
+)
+
+const (
+	scte35TableId            uint8 = 0xFC
+	scte35SpliceCommandNull        = 0x00
+	scte35SpliceCommandInsert      = 0x05
+	scte35TimeSignal               = 0x06
+)
+
+// Scte35CommandType splice_command_type，见SCTE-35标准4.3.1节
+//
+type Scte35CommandType uint8
+
+const (
+	Scte35CommandTypeSpliceNull   Scte35CommandType = scte35SpliceCommandNull
+	Scte35CommandTypeSpliceInsert Scte35CommandType = scte35SpliceCommandInsert
+	Scte35CommandTypeTimeSignal   Scte35CommandType = scte35TimeSignal
+)
+
+// Scte35Command 一次splice_info_section携带的splice command，字段含义见SCTE-35标准
+//
+type Scte35Command struct {
+	Type Scte35CommandType
+
+	// 以下字段仅Type==Scte35CommandTypeSpliceInsert时使用
+	SpliceEventId         uint32
+	OutOfNetworkIndicator bool // true表示广告开始（cue-out），false表示广告结束（cue-in）
+	DurationSet           bool
+	Duration              uint64 // 单位90kHz，auto_return场景下的break_duration
+	UniqueProgramId       uint16
+	AvailNum              uint8
+	AvailsExpected        uint8
+}
+
+// InsertScte35
+//
+// 插入一个SCTE-35 splice_info_section，封装成不带PES头的TS section（payload_unit_start_indicator=1，pointer_field=0），
+// 写入独立的PID（pidScte35），并把这次插入作为一个boundary hint转发给上层，方便HLS/CMAF封装层对齐切出
+// #EXT-X-CUE-OUT/#EXT-X-DATERANGE需要的分片边界
+//
+// @param pts: 90kHz时间基，即splice point的时间点
+//
+func (s *Rtmp2MpegtsRemuxer) InsertScte35(cmd Scte35Command, pts uint64) {
+	section := packScte35SpliceInfoSection(cmd, pts)
+	packets := packTsSection(section, pidScte35, &s.scte35Cc)
+
+	// 标记下一个视频帧为边界，使得HLS/CMAF打包器可以在splice点对齐切片
+	s.pendingScte35Boundary = true
+
+	s.observer.OnScte35Section(packets, cmd, pts)
+}
+
+// packScte35SpliceInfoSection 按SCTE-35标准拼装splice_info_section（不含CRC32时的payload部分先拼好，最后再补CRC32）
+//
+func packScte35SpliceInfoSection(cmd Scte35Command, pts uint64) []byte {
+	var spliceCommand []byte
+	switch cmd.Type {
+	case Scte35CommandTypeSpliceInsert:
+		spliceCommand = packScte35SpliceInsert(cmd, pts)
+	case Scte35CommandTypeTimeSignal:
+		spliceCommand = packScte35SpliceTime(pts)
+	default:
+		spliceCommand = nil // splice_null没有payload
+	}
+
+	// splice_info_section除了table_id和section_length字段外的部分，字段顺序和位宽严格按SCTE-35标准4.3.1节排布：
+	// protocol_version(8) + encrypted_packet(1)+encryption_algorithm(6)+pts_adjustment(33) [共5字节] +
+	// cw_index(8) + tier(12)+splice_command_length(12) [共3字节] + splice_command_type(8) +
+	// splice_command() + descriptor_loop_length(16)
+	body := make([]byte, 0, 12+len(spliceCommand))
+	body = append(body, 0x00) // protocol_version
+
+	// encrypted_packet=0，encryption_algorithm=0（不加密），pts_adjustment=0（不整体调整时间戳）
+	body = append(body, 0x00, 0x00, 0x00, 0x00, 0x00)
+
+	body = append(body, 0xFF) // cw_index，未加密时该字段含义未定义，按惯例填0xFF
+
+	// tier(12bit)全1表示未使用 + splice_command_length(12bit)，共3字节
+	tierAndCmdLen := uint32(0xFFF)<<12 | uint32(len(spliceCommand)&0xFFF)
+	body = append(body, byte(tierAndCmdLen>>16), byte(tierAndCmdLen>>8), byte(tierAndCmdLen))
+
+	body = append(body, byte(cmd.Type))
+	body = append(body, spliceCommand...)
+	body = append(body, 0x00, 0x00) // descriptor_loop_length=0，暂不附加descriptor
+
+	section := make([]byte, 0, 3+len(body)+4)
+	section = append(section, scte35TableId)
+
+	// section_syntax_indicator(1)=0 + private_indicator(1)=0 + reserved(2)=11 + section_length(12)
+	sectionLength := uint16(len(body) + 4) // +4是末尾的CRC32
+	var secLenBuf [2]byte
+	bele.BePutUint16(secLenBuf[:], sectionLength&0xFFF|0x3000)
+	section = append(section, secLenBuf[:]...)
+	section = append(section, body...)
+
+	crc := crc32Mpeg(section)
+	var crcBuf [4]byte
+	bele.BePutUint32(crcBuf[:], crc)
+	section = append(section, crcBuf[:]...)
+
+	return section
+}
+
+// packScte35SpliceInsert splice_insert()，只实现了spec_out/cue-in所必需的字段，program_splice=1, splice_immediate根据duration是否设置决定
+//
+func packScte35SpliceInsert(cmd Scte35Command, pts uint64) []byte {
+	b := make([]byte, 0, 20)
+
+	var eventIdBuf [4]byte
+	bele.BePutUint32(eventIdBuf[:], cmd.SpliceEventId)
+	b = append(b, eventIdBuf[:]...)
+
+	var cancelIndicator byte // splice_event_cancel_indicator=0
+	b = append(b, cancelIndicator)
+
+	var outOfNetwork byte
+	if cmd.OutOfNetworkIndicator {
+		outOfNetwork = 0x80
+	}
+	// program_splice_flag(1)=1 + duration_flag(1) + splice_immediate_flag(1)
+	flags := outOfNetwork | 0x40
+	spliceImmediate := cmd.Type == Scte35CommandTypeSpliceInsert && !cmd.DurationSet
+	if cmd.DurationSet {
+		flags |= 0x20
+	}
+	if spliceImmediate {
+		flags |= 0x10
+	}
+	b = append(b, flags)
+
+	if !spliceImmediate {
+		b = append(b, packScte35SpliceTime(pts)...)
+	}
+
+	if cmd.DurationSet {
+		var durBuf [5]byte
+		durBuf[0] = 0x80 // auto_return=1
+		v := cmd.Duration & 0x1FFFFFFFF
+		durBuf[0] |= byte(v >> 32)
+		bele.BePutUint32(durBuf[1:], uint32(v))
+		b = append(b, durBuf[:]...)
+	}
+
+	var uniqueProgramIdBuf [2]byte
+	bele.BePutUint16(uniqueProgramIdBuf[:], cmd.UniqueProgramId)
+	b = append(b, uniqueProgramIdBuf[:]...)
+	b = append(b, cmd.AvailNum, cmd.AvailsExpected)
+
+	return b
+}
+
+// packScte35SpliceTime splice_time()，time_specified_flag=1
+//
+func packScte35SpliceTime(pts uint64) []byte {
+	b := make([]byte, 5)
+	v := pts & 0x1FFFFFFFF
+	b[0] = 0x80 | byte(v>>32)
+	bele.BePutUint32(b[1:], uint32(v))
+	return b
+}
+
+// crc32Mpeg CRC-32/MPEG-2：多项式0x04C11DB7，初始值0xFFFFFFFF，不反转，无最终异或
+//
+func crc32Mpeg(data []byte) uint32 {
+	const poly = 0x04C11DB7
+	crc := uint32(0xFFFFFFFF)
+	for _, b := range data {
+		crc ^= uint32(b) << 24
+		for i := 0; i < 8; i++ {
+			if crc&0x80000000 != 0 {
+				crc = (crc << 1) ^ poly
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// packTsSection 把一段PSI/SI section（已包含CRC32）封装成TS包，payload_unit_start_indicator=1，pointer_field=0，
+// 不足188字节用0xFF填充，与mpegts.PackTsPacket生成PES的打包方式区分开（section没有PES头）
+//
+func packTsSection(section []byte, pid uint16, cc *uint8) []byte {
+	data := make([]byte, 0, len(section)+1)
+	data = append(data, 0x00) // pointer_field
+	data = append(data, section...)
+
+	var out []byte
+	first := true
+	for len(data) > 0 {
+		packet := make([]byte, tsPacketSize)
+		packet[0] = 0x47
+		pusi := byte(0)
+		if first {
+			pusi = 0x40
+		}
+		packet[1] = pusi | byte(pid>>8)&0x1F
+		packet[2] = byte(pid)
+		packet[3] = 0x10 | (*cc & 0xF) // 无adaptation field，payload_only
+		*cc = (*cc + 1) & 0xF
+
+		n := copy(packet[4:], data)
+		data = data[n:]
+		for i := 4 + n; i < tsPacketSize; i++ {
+			packet[i] = 0xFF
+		}
+
+		out = append(out, packet...)
+		first = false
+	}
+	return out
+}
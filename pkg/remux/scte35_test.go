@@ -0,0 +1,114 @@
+// Copyright 2020, Chef.  All rights reserved.
+// https://github.com/q191201771/lal
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package remux
+
+import (
+	"testing"
+
+	"github.com/q191201771/naza/pkg/bele"
+)
+
+func TestPackScte35SpliceInfoSection_TimeSignal(t *testing.T) {
+	const pts = uint64(0x123456789)
+
+	section := packScte35SpliceInfoSection(Scte35Command{Type: Scte35CommandTypeTimeSignal}, pts)
+
+	if section[0] != scte35TableId {
+		t.Fatalf("table_id mismatch. got=%#x", section[0])
+	}
+
+	sectionLength := int(bele.BeUint16(section[1:3]) & 0xFFF)
+	if 3+sectionLength != len(section) {
+		t.Fatalf("section_length mismatch. section_length=%d, len(section)=%d", sectionLength, len(section))
+	}
+
+	body := section[3:]
+	if body[0] != 0x00 {
+		t.Fatalf("protocol_version mismatch. got=%#x", body[0])
+	}
+
+	// encrypted_packet(1)+encryption_algorithm(6)+pts_adjustment(33) 紧跟在protocol_version之后，共5字节
+	for i := 1; i <= 5; i++ {
+		if body[i] != 0x00 {
+			t.Fatalf("encrypted_packet/encryption_algorithm/pts_adjustment byte %d should be 0, got=%#x", i, body[i])
+		}
+	}
+
+	cwIndex := body[6]
+	if cwIndex != 0xFF {
+		t.Fatalf("cw_index mismatch. got=%#x", cwIndex)
+	}
+
+	tierAndCmdLen := uint32(body[7])<<16 | uint32(body[8])<<8 | uint32(body[9])
+	spliceCommandLength := int(tierAndCmdLen & 0xFFF)
+	spliceCommandType := body[10]
+
+	if spliceCommandType != byte(Scte35CommandTypeTimeSignal) {
+		t.Fatalf("splice_command_type mismatch. got=%#x", spliceCommandType)
+	}
+	// time_signal()的splice_time()固定5字节
+	if spliceCommandLength != 5 {
+		t.Fatalf("splice_command_length mismatch. got=%d, want=5", spliceCommandLength)
+	}
+
+	spliceCommand := body[11 : 11+spliceCommandLength]
+	gotPts := (uint64(spliceCommand[0]&0x1) << 32) | uint64(bele.BeUint32(spliceCommand[1:5]))
+	if gotPts != pts&0x1FFFFFFFF {
+		t.Fatalf("pts mismatch. got=%#x, want=%#x", gotPts, pts&0x1FFFFFFFF)
+	}
+
+	descriptorLoopLengthPos := 11 + spliceCommandLength
+	descriptorLoopLength := bele.BeUint16(body[descriptorLoopLengthPos : descriptorLoopLengthPos+2])
+	if descriptorLoopLength != 0 {
+		t.Fatalf("descriptor_loop_length mismatch. got=%d", descriptorLoopLength)
+	}
+
+	// CRC32覆盖section中除CRC32自身以外的所有字节
+	payload := section[:len(section)-4]
+	wantCrc := bele.BeUint32(section[len(section)-4:])
+	if crc32Mpeg(payload) != wantCrc {
+		t.Fatalf("crc32 mismatch. got=%#x, want=%#x", crc32Mpeg(payload), wantCrc)
+	}
+}
+
+func TestPackScte35SpliceInfoSection_SpliceInsert(t *testing.T) {
+	cmd := Scte35Command{
+		Type:                  Scte35CommandTypeSpliceInsert,
+		SpliceEventId:         100,
+		OutOfNetworkIndicator: true,
+		DurationSet:           true,
+		Duration:              30 * 90000,
+		UniqueProgramId:       1,
+		AvailNum:              0,
+		AvailsExpected:        0,
+	}
+
+	section := packScte35SpliceInfoSection(cmd, 0)
+
+	body := section[3:]
+	spliceCommandType := body[10]
+	if spliceCommandType != byte(Scte35CommandTypeSpliceInsert) {
+		t.Fatalf("splice_command_type mismatch. got=%#x", spliceCommandType)
+	}
+
+	tierAndCmdLen := uint32(body[7])<<16 | uint32(body[8])<<8 | uint32(body[9])
+	spliceCommandLength := int(tierAndCmdLen & 0xFFF)
+
+	spliceCommand := body[11 : 11+spliceCommandLength]
+	gotEventId := bele.BeUint32(spliceCommand[0:4])
+	if gotEventId != cmd.SpliceEventId {
+		t.Fatalf("splice_event_id mismatch. got=%d, want=%d", gotEventId, cmd.SpliceEventId)
+	}
+
+	payload := section[:len(section)-4]
+	wantCrc := bele.BeUint32(section[len(section)-4:])
+	if crc32Mpeg(payload) != wantCrc {
+		t.Fatalf("crc32 mismatch")
+	}
+}